@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"net/url"
 
+	"github.com/lytics/escp/esbulk"
+	"github.com/lytics/escp/esscroll"
 	"github.com/lytics/escp/jobs"
 	log "github.com/lytics/escp/logging"
 )
@@ -19,6 +26,8 @@ func main() {
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s http://SRCHOST1:9200 INDEX1 DESHOST2:9200,DESHOST3:9200,DESHOST4:9200 INDEX2\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -replay-deadletter FILE DESHOST2:9200,DESHOST3:9200 INDEX2\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s replicate -sync FIELD http://SRCHOST1:9200 INDEX1 DESHOST2:9200 INDEX2\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -30,17 +39,26 @@ func main() {
 
 	// Tunables
 	scrolltimeout := 15 * time.Minute
-	flag.DurationVar(&scrolltimeout, "scrolltime", scrolltimeout, "time to keep scroll alive between requests")
+	flag.DurationVar(&scrolltimeout, "scrolltime", scrolltimeout, "time to keep scroll or point in time alive between requests")
 	scrollpage := 1000
 	flag.IntVar(&scrollpage, "scrollpage", scrollpage, "size of scroll pages (will actually be per source shard)")
 	scrolldocs := 5000
 	flag.IntVar(&scrolldocs, "scrolldocs", scrolldocs, "number of `docs` to buffer in memory from scroll")
+	slices := 1
+	flag.IntVar(&slices, "slices", slices, "number of sliced scrolls to read from the source concurrently")
 	bulksz := 128
 	flag.IntVar(&bulksz, "bulksz", bulksz, "size of bulk upload buffer in `KB`")
 
 	bulkpar := 0
 	flag.IntVar(&bulkpar, "bulkpar", bulkpar, "number of parallel bulk upload buffers to use; 0 = len(hosts)*2")
 
+	adaptive := false
+	flag.BoolVar(&adaptive, "adaptive", adaptive, "adapt the bulk size and parallelism to cluster pushback, starting from -bulksz and -bulkpar")
+	maxbulksz := 0
+	flag.IntVar(&maxbulksz, "maxbulksz", maxbulksz, "if adaptive, the largest bulk upload buffer in `KB`; 0 = 4*bulksz")
+	maxbulkpar := 0
+	flag.IntVar(&maxbulkpar, "maxbulkpar", maxbulkpar, "if adaptive, the most parallel bulk uploads; 0 = 4*bulkpar")
+
 	delayrefresh := true
 	flag.BoolVar(&delayrefresh, "delayrefresh", delayrefresh, "delay refresh until bulk indexing is complete")
 	delayreplicaton := false
@@ -52,15 +70,122 @@ func main() {
 	flag.DurationVar(&refreshint, "refreshint", refreshint, "if indexing is delayed, what to set the refresh interval to after copy; defaults to old index's setting or 1s")
 	maxsegs := 5
 	flag.IntVar(&maxsegs, "maxsegs", maxsegs, "if indexing is delayed, the max number of segments for the optimized index")
-	createdelay := time.Second
-	flag.DurationVar(&createdelay, "createdelay", createdelay, "time to sleep after index creation to let cluster go green")
+	mapping := ""
+	flag.StringVar(&mapping, "mapping", mapping, "create the destination index with the mappings, settings.analysis and aliases in this JSON `file` instead of the source's")
+	copyaliases := false
+	flag.BoolVar(&copyaliases, "copyaliases", copyaliases, "create the destination index with the source index's aliases")
+	createdelay := time.Duration(0)
+	flag.DurationVar(&createdelay, "createdelay", createdelay, "if set, sleep this long after index creation instead of waiting for -health")
+	health := "green"
+	flag.StringVar(&health, "health", health, "index health `status`, green or yellow, to wait for after creating the index and before completing the copy; single-node clusters never go green if the index has replicas")
+	healthtimeout := 30 * time.Minute
+	flag.DurationVar(&healthtimeout, "healthtimeout", healthtimeout, "how long to wait for the -health index health status")
+
+	checkpoint := ""
+	flag.StringVar(&checkpoint, "checkpoint", checkpoint, "record acknowledged progress in this `file`; reads the source sorted by _id instead of scrolling")
+	pit := false
+	flag.BoolVar(&pit, "pit", pit, "read the source with a point in time and search_after instead of a scroll; requires ES 7.10+")
+	sortfield := ""
+	flag.StringVar(&sortfield, "sortfield", sortfield, "keyword `field` holding each document's _id to sort -checkpoint, -pit, -reconcile and replicate reads by where sorting by _id is disallowed")
+	resume := ""
+	flag.StringVar(&resume, "resume", resume, "resume the copy recorded in this checkpoint `file` into the existing destination index")
+	cursors := ""
+	flag.StringVar(&cursors, "cursors", cursors, "continue the stopped copy whose scroll cursors were saved to this JSON `file` into the existing destination index, before the scrolls expire")
+	savecursors := ""
+	flag.StringVar(&savecursors, "savecursors", savecursors, "`file` to save the scroll cursors to when a copy stops early, for -cursors; defaults to -cursors or <destination index>.cursors.json")
+
+	deadletter := ""
+	flag.StringVar(&deadletter, "deadletter", deadletter, "`file` to write documents that permanently fail indexing to; defaults to <destination index>.deadletter.ndjson, none to drop them")
+	maxretries := 64
+	flag.IntVar(&maxretries, "maxretries", maxretries, "attempts to index a bulk batch before dead-lettering what's left of it")
+	permanent := ""
+	flag.StringVar(&permanent, "permanent-errors", permanent, "comma separated list of additional ES error types that are never retried")
+	throttled := ""
+	flag.StringVar(&throttled, "throttled-errors", throttled, "comma separated list of additional ES error types that are retried after backing off")
+	replay := ""
+	flag.StringVar(&replay, "replay-deadletter", replay, "retry the documents in this dead-letter `file` against the destination index instead of copying")
+
+	alias := ""
+	flag.StringVar(&alias, "alias", alias, "after copying and validating, atomically move this `alias` on the destination cluster to the destination index")
+	aliascheck := 1000
+	flag.IntVar(&aliascheck, "aliascheck", aliascheck, "if alias is set, validate 1/`N` of documents before moving it")
+
+	syncfield := ""
+	flag.StringVar(&syncfield, "sync", syncfield, "only copy documents whose timestamp `field` changed since the last sync between the same indexes; the first sync copies everything")
+	syncstate := "escp-sync.json"
+	flag.StringVar(&syncstate, "syncstate", syncstate, "`file` to keep the high-water marks of syncs in")
+	syncoverlap := ""
+	flag.StringVar(&syncoverlap, "syncoverlap", syncoverlap, "date math `duration`, like 5m, to resync before the high-water mark to catch documents that weren't searchable yet")
+
+	reconcile := false
+	flag.BoolVar(&reconcile, "reconcile", reconcile, "instead of copying, delete the documents of the destination index that aren't in the source")
+	dryrun := false
+	flag.BoolVar(&dryrun, "dryrun", dryrun, "if reconciling, only log the documents that would be deleted")
+
+	keepversions := false
+	flag.BoolVar(&keepversions, "keepversions", keepversions, "index documents with their source _version using version_type=external")
+	seqno := false
+	flag.BoolVar(&seqno, "seqno", seqno, "read _seq_no and _primary_term of source documents; requires ES 6.7+")
+
+	interval := time.Minute
+	flag.DurationVar(&interval, "interval", interval, "if replicating, time between sync passes")
+	statusaddr := ""
+	flag.StringVar(&statusaddr, "statusaddr", statusaddr, "if replicating, serve the replication status and lag as JSON on this `address`, e.g. :8080")
 
 	logevery := 10 * time.Minute
 	flag.DurationVar(&logevery, "logevery", logevery, "rate at which to log progress metrics.")
 
+	replicate := len(os.Args) > 1 && os.Args[1] == "replicate"
+	if replicate {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
 
 	bulksz = bulksz * 1024 //convert to KBs
+	maxbulksz = maxbulksz * 1024
+
+	retry := esbulk.DefaultRetryPolicy()
+	retry.MaxRetries = maxretries
+	if permanent != "" {
+		retry.PermanentTypes = append(retry.PermanentTypes, strings.Split(permanent, ",")...)
+	}
+	if throttled != "" {
+		retry.ThrottledTypes = append(retry.ThrottledTypes, strings.Split(throttled, ",")...)
+	}
+
+	if replay != "" {
+		if flag.NArg() != 2 {
+			logger.Errorf("expected 2 arguments, found %d\n", flag.NArg())
+			flag.Usage()
+			os.Exit(1)
+		}
+		deadletter = deadLetterFile(deadletter, flag.Arg(1))
+		if deadletter == replay {
+			deadletter = replay + ".replay"
+			logger.Infof("documents failing again will be written to %s", deadletter)
+		}
+		dsts := parseHosts(flag.Arg(0), logger)
+		if bulkpar == 0 {
+			bulkpar = len(dsts) * 2
+		}
+		desC := &jobs.DesConfig{
+			IndexName:  flag.Arg(1),
+			Hosts:      dsts,
+			BulkSize:   bulksz,
+			NumWorkers: bulkpar,
+			DeadLetter: deadletter,
+			Retry:      retry,
+
+			AdaptiveBulk: adaptive,
+			MaxBulkSize:  maxbulksz,
+			MaxWorkers:   maxbulkpar,
+		}
+		if keepversions {
+			desC.VersionType = "external"
+		}
+		exitOn(jobs.ReplayDeadLetters(context.Background(), replay, desC, logger), logger)
+		return
+	}
 
 	if flag.NArg() != 4 {
 		logger.Errorf("expected 4 arguments, found %d\n", flag.NArg())
@@ -72,6 +197,39 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if mapping != "" && skipcreate {
+		logger.Errorf("cannot set mapping and skip index creation")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if checkpoint != "" && resume != "" {
+		logger.Errorf("cannot set both checkpoint and resume")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if replicate && syncfield == "" {
+		logger.Errorf("replicate requires a sync field")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if syncfield != "" && (resume != "" || alias != "") {
+		logger.Errorf("cannot sync with resume or alias")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if cursors != "" && (checkpoint != "" || resume != "" || pit || syncfield != "" || replicate) {
+		logger.Errorf("cannot continue scroll cursors with checkpoint, resume, pit, sync or replicate")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if resume != "" {
+		checkpoint = resume
+	}
+	if (checkpoint != "" || pit || replicate) && slices > 1 {
+		logger.Errorf("cannot use sliced scrolls with checkpoints, point in time reads or replicate")
+		flag.Usage()
+		os.Exit(1)
+	}
 
 	src, err := jobs.ParseUrl(flag.Arg(0))
 	if err != nil {
@@ -83,21 +241,7 @@ func main() {
 		srcIdx = srcIdx[:len(srcIdx)-1]
 	}
 
-	dstsR := strings.Split(flag.Arg(2), ",")
-	if len(dstsR) < 1 {
-		logger.Errorf("need at least one destination host")
-		flag.Usage()
-		os.Exit(1)
-	}
-	dsts := []*url.URL{}
-	for _, u := range dstsR {
-		d, err := jobs.ParseUrl(u)
-		if err != nil {
-			logger.Errorf("error parsing url:%v err:%v", u, err)
-			os.Exit(1)
-		}
-		dsts = append(dsts, d)
-	}
+	dsts := parseHosts(flag.Arg(2), logger)
 	desidx := flag.Arg(3)
 
 	if bulkpar == 0 {
@@ -110,12 +254,19 @@ func main() {
 		ScrollTimeout: scrolltimeout,
 		ScrollPage:    scrollpage,
 		ScrollDocs:    scrolldocs,
+		Slices:        slices,
 		Filter:        nil,
+		Sorted:        checkpoint != "" || pit || replicate,
+		PIT:           pit,
+		SortField:     sortfield,
+		HitMeta:       esscroll.HitMeta{Version: keepversions, SeqNo: seqno},
 	}
 	desC := &jobs.DesConfig{
 		IndexName:         desidx,
 		Hosts:             dsts,
 		CreateDelay:       createdelay,
+		HealthStatus:      health,
+		HealthTimeout:     healthtimeout,
 		RefreshInt:        refreshint,
 		Shards:            shards,
 		DelayRefresh:      delayrefresh,
@@ -123,13 +274,145 @@ func main() {
 		DelayReplicaton:   delayreplicaton,
 		ReplicationFactor: replicationfactor,
 		MaxSeg:            maxsegs,
+		Mapping:           mapping,
+		CopyAliases:       copyaliases,
 		BulkSize:          bulksz,
 		NumWorkers:        bulkpar,
+		Checkpoint:        checkpoint,
+		Resume:            resume != "",
+		DeadLetter:        deadLetterFile(deadletter, desidx),
+		Retry:             retry,
+		AdaptiveBulk:      adaptive,
+		MaxBulkSize:       maxbulksz,
+		MaxWorkers:        maxbulkpar,
+	}
+	if keepversions {
+		desC.VersionType = "external"
+	}
+	if cursors != "" {
+		b, err := ioutil.ReadFile(cursors)
+		if err != nil {
+			logger.Errorf("error reading cursors: %v", err)
+			os.Exit(1)
+		}
+		if err := json.Unmarshal(b, &srcC.Cursors); err != nil {
+			logger.Errorf("error decoding cursors %s: %v", cursors, err)
+			os.Exit(1)
+		}
+		desC.SkipCreate = true
 	}
 
-	if err := jobs.Copy(context.Background(), srcC, desC, logger, logevery); err != nil {
-		logger.Errorf("%v", err)
+	if reconcile {
+		_, err := jobs.Reconcile(context.Background(), srcC, desC, dryrun, logger, logevery)
+		exitOn(err, logger)
+		return
+	}
+
+	if replicate {
+		cfg := &jobs.ReplicateConfig{
+			SyncConfig: jobs.SyncConfig{Field: syncfield, State: syncstate, Overlap: syncoverlap},
+			Interval:   interval,
+		}
+		r := jobs.NewReplicator(srcC, desC, cfg, logger, logevery)
+		if statusaddr != "" {
+			go serveStatus(statusaddr, r, logger)
+		}
+		exitOn(r.Run(signalContext(logger)), logger)
+		logger.Infof("replication status: %v", r.Status())
+		return
+	}
+
+	if syncfield != "" {
+		syncC := &jobs.SyncConfig{Field: syncfield, State: syncstate, Overlap: syncoverlap}
+		exitOn(jobs.Sync(context.Background(), srcC, desC, syncC, logger, logevery), logger)
+		return
+	}
+
+	if alias != "" {
+		vr, err := jobs.Cutover(context.Background(), srcC, desC, alias, &jobs.ValidateOptions{Denom: aliascheck}, logger, logevery)
+		if vr != nil && len(vr.Details) > 0 {
+			logger.Warnf("validation found: %v", vr.Details)
+		}
+		exitOn(err, logger)
+		return
+	}
+
+	srcC.CursorFile = savecursors
+	if srcC.CursorFile == "" {
+		srcC.CursorFile = cursors
+	}
+	if srcC.CursorFile == "" && !srcC.Sorted {
+		srcC.CursorFile = desC.IndexName + ".cursors.json"
+	}
+	exitOn(jobs.Copy(signalContext(logger), srcC, desC, logger, logevery), logger)
+}
+
+// deadLetterFile returns the dead-letter file flag value for index.
+func deadLetterFile(flagval, index string) string {
+	switch flagval {
+	case "":
+		return index + ".deadletter.ndjson"
+	case "none":
+		return ""
+	}
+	return flagval
+}
+
+// parseHosts parses a comma separated list of destination hosts.
+func parseHosts(hosts string, logger log.Logger) []*url.URL {
+	dstsR := strings.Split(hosts, ",")
+	if len(dstsR) < 1 {
+		logger.Errorf("need at least one destination host")
+		flag.Usage()
 		os.Exit(1)
 	}
+	dsts := []*url.URL{}
+	for _, u := range dstsR {
+		d, err := jobs.ParseUrl(u)
+		if err != nil {
+			logger.Errorf("error parsing url:%v err:%v", u, err)
+			os.Exit(1)
+		}
+		dsts = append(dsts, d)
+	}
+	return dsts
+}
+
+// signalContext returns a context that is canceled on SIGTERM or SIGINT.
+func signalContext(logger log.Logger) context.Context {
+	ctx, can := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		logger.Infof("received %v; finishing in-flight uploads, signal again to exit immediately", sig)
+		signal.Stop(sigs)
+		can()
+	}()
+	return ctx
+}
 
+// serveStatus serves the status of r as JSON on addr.
+func serveStatus(addr string, r *jobs.Replicator, logger log.Logger) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Status())
+	})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Errorf("error serving status on %s: %v", addr, err)
+	}
+}
+
+// exitOn exits non-zero if err is set. Dead-lettered documents exit with 3 so
+// they can be told apart from failed copies.
+func exitOn(err error, logger log.Logger) {
+	switch {
+	case err == nil:
+	case err == jobs.ErrDeadLettered:
+		os.Exit(3)
+	default:
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
 }
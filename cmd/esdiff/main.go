@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/lytics/escp/esdiff"
 	"github.com/lytics/escp/jobs"
 	log "github.com/lytics/escp/logging"
 )
@@ -18,6 +19,7 @@ func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s http://host1:9200 index1 http://host2:9200 index2\n", os.Args[0])
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "Exits %d if the indexes match, %d if they don't and %d on errors.\n", exitMatch, exitMismatch, exitError)
 	}
 	timeout := "10m"
 	flag.StringVar(&timeout, "timeout", timeout, "time to keep scroll cursor alive")
@@ -25,6 +27,32 @@ func main() {
 	flag.IntVar(&pagesz, "page", pagesz, "documents to retrieve at once from each shard")
 	denom := 1000
 	flag.IntVar(&denom, "d", denom, "1/`N` chance of each document being checked")
+	seed := int64(0)
+	flag.Int64Var(&seed, "seed", seed, "seed of the sample; runs with the same seed check the same documents. 0 picks a random seed")
+	strata := ""
+	flag.StringVar(&strata, "strata", strata, "stratify the sample by _type or a source `field` and report each stratum's results")
+	minstratum := 100
+	flag.IntVar(&minstratum, "minstratum", minstratum, "if -strata, documents of every stratum to check regardless of -d")
+	extra := false
+	flag.BoolVar(&extra, "extra", extra, "also read every destination id and list documents that aren't in the source")
+	batch := 100
+	flag.IntVar(&batch, "batch", batch, "documents to check per _mget request")
+	concurrency := 4
+	flag.IntVar(&concurrency, "concurrency", concurrency, "_mget requests to run in parallel")
+	digest := false
+	flag.BoolVar(&digest, "digest", digest, "compare every document by digests of both indexes sorted by _id instead of sampling")
+	sortfield := ""
+	flag.StringVar(&sortfield, "sortfield", sortfield, "keyword `field` holding each document's _id to sort -digest and -extra reads by where sorting by _id is disallowed")
+	bucket := 1000
+	flag.IntVar(&bucket, "bucket", bucket, "if -digest, source documents per digest bucket")
+	rulesfile := ""
+	flag.StringVar(&rulesfile, "rules", rulesfile, "JSON `file` of comparison rules: ignore, tolerance, unordered and null_is_missing")
+	report := ""
+	flag.StringVar(&report, "report", report, "write a report of the results in `format` json or junit")
+	out := "-"
+	flag.StringVar(&out, "o", out, "`file` to write the -report to; - for stdout")
+	repair := false
+	flag.BoolVar(&repair, "repair", repair, "re-copy the missing and mismatched documents found from the source and check them again")
 	force := false
 	flag.BoolVar(&force, "force", force, "continue check even if document count varies")
 	logevery := 10 * time.Minute
@@ -34,11 +62,14 @@ func main() {
 	if flag.NArg() != 4 {
 		fatalf("requires 2 arguments")
 	}
+	if report != "" && report != jobs.ReportJSON && report != jobs.ReportJUnit {
+		fatalf("unknown -report format %q", report)
+	}
 
 	surl, err := jobs.ParseUrl(flag.Arg(0))
 	if err != nil {
 		logger.Errorf("error parsing url:%v err:%v", flag.Arg(0), err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 	srcIdx := flag.Arg(1)
 	if strings.HasSuffix(srcIdx, "/") {
@@ -48,23 +79,20 @@ func main() {
 	durl, err := jobs.ParseUrl(flag.Arg(2))
 	if err != nil {
 		logger.Errorf("error parsing url:%v err:%v", flag.Arg(2), err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 	dstIdx := flag.Arg(3)
 	if strings.HasSuffix(dstIdx, "/") {
 		dstIdx = dstIdx[:len(dstIdx)-1]
 	}
 
-	if denom < 2 {
-		denom = 1
-	}
-
 	srcC := &jobs.SourceConfig{
 		IndexName:     srcIdx,
 		Host:          surl,
 		ScrollTimeout: time.Minute,
 		ScrollPage:    1000,
 		ScrollDocs:    1,
+		SortField:     sortfield,
 	}
 
 	desC := &jobs.DesConfig{
@@ -72,19 +100,84 @@ func main() {
 		Hosts:     []*url.URL{durl},
 	}
 
-	vr, err := jobs.Validate(context.Background(), srcC, desC, denom, logger, logevery)
+	var rules *esdiff.Rules
+	if rulesfile != "" {
+		if rules, err = esdiff.LoadRules(rulesfile); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(exitError)
+		}
+	}
+
+	opts := &jobs.ValidateOptions{Denom: denom, Seed: seed, Strata: strata, MinPerStratum: minstratum,
+		Force: force, Extra: extra, BatchSize: batch, Concurrency: concurrency,
+		Digest: digest, BucketSize: bucket, Rules: rules}
+	vr, err := jobs.Validate(context.Background(), srcC, desC, opts, logger, logevery)
 	//logger.Errorf("?: %v  %v", problems, err)
 	if err == jobs.ErrMissMatch {
 		logger.Errorf("MissMatch: %v", vr)
+		for _, d := range vr.Details {
+			logger.Errorf("  %s", d)
+		}
 	} else if err != nil {
 		logger.Errorf("validation failed with error:%v", err)
 	} else {
 		logger.Infof("results:%v", vr)
 	}
+
+	r := jobs.NewValidationReport(vr, err)
+	if repair && err == jobs.ErrMissMatch {
+		rr, err := jobs.Repair(context.Background(), srcC, desC, vr.Details, opts, logger, logevery)
+		r.Repair = rr
+		if err != nil {
+			logger.Errorf("repair failed with error:%v", err)
+			r.Result, r.Error = jobs.ResultError, err.Error()
+		} else {
+			r.Repaired(rr)
+			logger.Infof("repair:%v result:%s", rr, r.Result)
+			for _, d := range rr.Remaining {
+				logger.Errorf("  still %s", d)
+			}
+		}
+	}
+	if report != "" {
+		if err := writeReport(r, report, out); err != nil {
+			logger.Errorf("error writing report: %v", err)
+			os.Exit(exitError)
+		}
+	}
+	switch r.Result {
+	case jobs.ResultMismatch:
+		os.Exit(exitMismatch)
+	case jobs.ResultError:
+		os.Exit(exitError)
+	}
+}
+
+// Exit codes
+const (
+	exitMatch    = 0
+	exitMismatch = 1
+	exitError    = 2
+)
+
+// writeReport to the file fn, or stdout if fn is "-".
+func writeReport(r *jobs.ValidationReport, format, fn string) error {
+	if fn == "-" {
+		return r.Write(os.Stdout, format)
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := r.Write(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func fatalf(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, "fatal error: "+msg+"\n", args...)
 	flag.Usage()
-	os.Exit(2)
+	os.Exit(exitError)
 }
@@ -79,9 +79,11 @@ func main() {
 	}
 
 	filter := map[string]interface{}{
-		"and": []interface{}{
-			timeRangeFilter,
-			docValueFilter,
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				timeRangeFilter,
+				docValueFilter,
+			},
 		},
 	}
 
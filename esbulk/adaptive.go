@@ -0,0 +1,148 @@
+package esbulk
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lytics/escp/esscroll"
+)
+
+// controller sets the batch size and number of parallel uploads of an
+// Indexer. When adaptive it grows them additively while uploads are fast and
+// shrinks them multiplicatively on throttling or rising upload latency, at
+// most once per window of uploads that were in flight when they last changed.
+// Otherwise it keeps them fixed and only collects stats.
+type controller struct {
+	adaptive         bool
+	minSize, maxSize int
+	minPar, maxPar   int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	size     int
+	par      int
+	inflight int
+
+	latency  time.Duration // moving average of upload latency per KB
+	baseline time.Duration // lowest average latency per KB seen
+	since    int           // uploads since the last change
+	window   int           // uploads in flight at the last change, which started before it
+	uploads  uint64
+	throttle uint64
+	docs     uint64
+}
+
+func newController(cfg *Config, size, par int) *controller {
+	c := &controller{size: size, par: par, minSize: size, maxSize: size, minPar: par, maxPar: par}
+	if cfg.Adaptive {
+		c.adaptive = true
+		c.minSize, c.minPar = max(1024, size/8), 1
+		c.maxSize, c.maxPar = cfg.MaxBufSize, cfg.MaxPar
+		if c.maxSize < size {
+			c.maxSize = size * 4
+		}
+		if c.maxPar < par {
+			c.maxPar = par * 4
+		}
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// uploadAt returns the number of bytes at which a batch should be uploaded.
+func (c *controller) uploadAt() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size > 1000 {
+		// upload at 500kb less than buffer size to avoid buffer resizing
+		return c.size - 500
+	}
+	return c.size
+}
+
+// acquire blocks until fewer than par uploads are in flight.
+func (c *controller) acquire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.inflight >= c.par {
+		c.cond.Wait()
+	}
+	c.inflight++
+}
+
+// release an upload started with acquire after n docs were uploaded.
+func (c *controller) release(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight--
+	c.docs += uint64(n)
+	c.cond.Broadcast()
+}
+
+// observe a bulk request of n bytes that took latency, and whether the cluster
+// pushed back on it.
+func (c *controller) observe(latency time.Duration, n int, throttled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	perKB := latency * 1024 / time.Duration(max(1, n))
+	if c.latency == 0 {
+		c.latency = perKB
+	} else {
+		c.latency = (c.latency*4 + perKB) / 5
+	}
+	if c.baseline == 0 || c.latency < c.baseline {
+		c.baseline = c.latency
+	}
+	c.uploads++
+	c.since++
+	if throttled {
+		c.throttle++
+	}
+	if !c.adaptive {
+		return
+	}
+
+	switch {
+	case throttled && c.since >= c.window:
+		// shrink once for the uploads rejected together, not once each
+		c.resize(c.size/2, c.par/2)
+	case throttled:
+		// already shrunk since this upload started
+	case c.latency > 2*c.baseline && c.since >= c.par:
+		c.resize(c.size*3/4, c.par-1)
+	case c.since >= 2*c.par:
+		c.resize(c.size+c.size/4, c.par+1)
+	}
+}
+
+// resize must be called with mu held.
+func (c *controller) resize(size, par int) {
+	c.size = min(c.maxSize, max(c.minSize, size))
+	c.par = min(c.maxPar, max(c.minPar, par))
+	c.since = 0
+	c.window = c.inflight
+}
+
+func (c *controller) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("bulksize:%v par:%v inflight:%v latency:%v/KB uploads:%v throttled:%v",
+		esscroll.IECFormat(uint64(c.size)), c.par, c.inflight, c.latency, c.uploads, c.throttle)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
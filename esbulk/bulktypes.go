@@ -8,29 +8,71 @@ import (
 )
 
 type BulkAction struct {
-	Index *estypes.Meta `json:"index,omitempty"`
+	Index  *ActionMeta `json:"index,omitempty"`
+	Delete *ActionMeta `json:"delete,omitempty"`
+}
+
+// ActionMeta is the metadata of a bulk action.
+type ActionMeta struct {
+	ID          string `json:"_id"`
+	Type        string `json:"_type,omitempty"`
+	Index       string `json:"_index"`
+	Routing     string `json:"routing,omitempty"`
+	Parent      string `json:"parent,omitempty"`
+	Version     int64  `json:"version,omitempty"`
+	VersionType string `json:"version_type,omitempty"`
 }
 
 func NewBatch() *Batch {
 	return &Batch{
-		docs: make(map[string]*estypes.Doc),
+		docs: make(map[string][]*estypes.Doc),
 	}
 }
 
+// Batch of documents by key, normally docKey. Adding a document with a key
+// already in the batch supersedes the earlier ones: only the last is written,
+// and the others are acknowledged along with it.
 type Batch struct {
-	docs map[string]*estypes.Doc
+	docs map[string][]*estypes.Doc
+}
+
+func (b *Batch) Reset() {
+	b.docs = make(map[string][]*estypes.Doc)
+}
+
+func (b Batch) Add(key string, doc *estypes.Doc) {
+	b.docs[key] = append(b.docs[key], doc)
 }
 
-func (b Batch) Reset() {
-	b.docs = make(map[string]*estypes.Doc)
+// Get the document with key, or nil if it isn't in the batch.
+func (b Batch) Get(key string) *estypes.Doc {
+	docs := b.docs[key]
+	if len(docs) == 0 {
+		return nil
+	}
+	return docs[len(docs)-1]
+}
+
+func (b Batch) Delete(key string) {
+	delete(b.docs, key)
 }
 
-func (b Batch) Add(id string, doc *estypes.Doc) {
-	b.docs[id] = doc
+// Docs returns the documents in the batch that are written.
+func (b Batch) Docs() []*estypes.Doc {
+	docs := make([]*estypes.Doc, 0, len(b.docs))
+	for _, kdocs := range b.docs {
+		docs = append(docs, kdocs[len(kdocs)-1])
+	}
+	return docs
 }
 
-func (b Batch) Delete(id string) {
-	delete(b.docs, id)
+// All returns every document added to the batch, including superseded ones.
+func (b Batch) All() []*estypes.Doc {
+	docs := make([]*estypes.Doc, 0, len(b.docs))
+	for _, kdocs := range b.docs {
+		docs = append(docs, kdocs...)
+	}
+	return docs
 }
 
 func (b Batch) Len() int {
@@ -39,23 +81,52 @@ func (b Batch) Len() int {
 
 func (b Batch) ByteLen() int {
 	totallen := 0
-	for _, bm := range b.docs {
+	for _, bm := range b.Docs() {
 		totallen += len(bm.Source)
 	}
 	return totallen
 }
 
-func (b Batch) Encode(index string) ([]byte, error) {
+// Encode the batch as the body of a bulk request to cfg.Index. If
+// cfg.VersionType is set, documents with a version are indexed with it.
+// Deletes are never versioned: the version of a document read from the
+// destination would always conflict with itself.
+//
+// If cfg.Typeless the documents' types are left out, and parents, which are
+// gone in Elasticsearch 7+, become the routing of their children.
+func (b Batch) Encode(cfg *Config) ([]byte, error) {
 	buf := bytes.NewBuffer([]byte{})
 	enc := json.NewEncoder(buf)
-	for _, doc := range b.docs {
+	for _, doc := range b.Docs() {
 		// Write action
-		action := BulkAction{}
-		action.Index = &doc.Meta
-		action.Index.Index = index
+		meta := &ActionMeta{
+			ID:      doc.ID,
+			Type:    doc.Type,
+			Index:   cfg.Index,
+			Routing: doc.Routing,
+			Parent:  doc.Parent,
+		}
+		if cfg.Typeless {
+			meta.Type = ""
+			meta.Parent = ""
+			if meta.Routing == "" {
+				meta.Routing = doc.Parent
+			}
+		}
+		if cfg.VersionType != "" && doc.Version > 0 && !doc.Delete {
+			meta.Version = doc.Version
+			meta.VersionType = cfg.VersionType
+		}
+		action := BulkAction{Index: meta}
+		if doc.Delete {
+			action = BulkAction{Delete: meta}
+		}
 		if err := enc.Encode(&action); err != nil {
 			return nil, err
 		}
+		if doc.Delete {
+			continue
+		}
 		// Write document
 		if err := enc.Encode(&doc.Source); err != nil {
 			return nil, err
@@ -137,6 +208,18 @@ func (r *BulkResponses) Succeeded(include404 bool) []*BulkResponse {
 	return succeeded
 }
 
+// Gone returns the items of a bulk response that deleted documents that
+// didn't exist.
+func (r *BulkResponses) Gone() []*BulkResponse {
+	gone := make([]*BulkResponse, 0)
+	for _, item := range r.Items {
+		if result, ok := item["delete"]; ok && result.Status == 404 && result.Error == nil {
+			gone = append(gone, result)
+		}
+	}
+	return gone
+}
+
 type BulkResponse struct {
 	Index   string           `json:"_index,omitempty"`
 	Type    string           `json:"_type,omitempty"`
@@ -0,0 +1,156 @@
+package esbulk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/lytics/escp/estypes"
+	"github.com/lytics/escp/pipeline"
+)
+
+// DeadLetter is a document that permanently failed bulk indexing.
+type DeadLetter struct {
+	Index  string          `json:"index,omitempty"` // destination index the document failed to be written to
+	Meta   estypes.Meta    `json:"meta"`
+	Source json.RawMessage `json:"source"`
+	Error  *ESError        `json:"error,omitempty"`  // last error returned for the document
+	Delete bool            `json:"delete,omitempty"` // the document failed to be deleted
+}
+
+// DeadLetterFile writes DeadLetters to a newline delimited JSON file. The file
+// is only created once the first document is written to it, and is appended
+// to if it exists.
+type DeadLetterFile struct {
+	path  string
+	index string
+
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	count uint64
+}
+
+// NewDeadLetterFile for documents that failed to be written to index.
+func NewDeadLetterFile(path, index string) *DeadLetterFile {
+	return &DeadLetterFile{path: path, index: index}
+}
+
+// Write a document and the last error returned for it, which may be nil.
+func (d *DeadLetterFile) Write(doc *estypes.Doc, eserr *ESError) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		f, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening dead-letter file: %v", err)
+		}
+		d.f = f
+		d.enc = json.NewEncoder(f)
+	}
+	if err := d.enc.Encode(&DeadLetter{Index: d.index, Meta: doc.Meta, Source: doc.Source, Error: eserr, Delete: doc.Delete}); err != nil {
+		return fmt.Errorf("error writing dead-letter file: %v", err)
+	}
+	d.count++
+	return nil
+}
+
+// Count of documents written.
+func (d *DeadLetterFile) Count() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+func (d *DeadLetterFile) Path() string { return d.path }
+
+func (d *DeadLetterFile) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
+
+// DeadLetterSource reads the documents of a dead-letter file back so they can
+// be retried.
+type DeadLetterSource struct {
+	path   string
+	buflen int
+
+	// Index, if set, is the only destination index the file may have
+	// documents for. Start fails on documents for other indexes. Files
+	// written before dead letters recorded their index are accepted.
+	Index string
+}
+
+var _ pipeline.Source = (*DeadLetterSource)(nil)
+
+func NewDeadLetterSource(path string, buflen int) *DeadLetterSource {
+	return &DeadLetterSource{path: path, buflen: buflen}
+}
+
+// Start reading the dead-letter file.
+func (s *DeadLetterSource) Start() (*pipeline.Response, error) {
+	total, err := s.count()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening dead-letter file: %v", err)
+	}
+
+	out := make(chan *estypes.Doc, s.buflen)
+	r := pipeline.NewResponse(total, out)
+	go func() {
+		defer close(out)
+		defer f.Close()
+		dec := json.NewDecoder(bufio.NewReader(f))
+		for dec.More() {
+			dl := DeadLetter{}
+			if err := dec.Decode(&dl); err != nil {
+				r.SetErr(fmt.Errorf("error decoding dead-letter file: %v", err))
+				return
+			}
+			out <- &estypes.Doc{Meta: dl.Meta, Source: dl.Source, Delete: dl.Delete}
+		}
+	}()
+	return r, nil
+}
+
+// count the documents in the dead-letter file, checking they are for Index.
+func (s *DeadLetterSource) count() (uint64, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening dead-letter file: %v", err)
+	}
+	defer f.Close()
+	var n uint64
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<30)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		n++
+		if s.Index == "" {
+			continue
+		}
+		dl := struct {
+			Index string `json:"index"`
+		}{}
+		if err := json.Unmarshal(sc.Bytes(), &dl); err != nil {
+			return 0, fmt.Errorf("error decoding dead-letter file: %v", err)
+		}
+		if dl.Index != "" && dl.Index != s.Index {
+			return 0, fmt.Errorf("dead-letter file %s has documents for index %s, not %s", s.path, dl.Index, s.Index)
+		}
+	}
+	return n, sc.Err()
+}
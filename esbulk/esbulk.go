@@ -7,8 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
-	"math/rand"
 	"net/http"
 	"strings"
 	"sync"
@@ -17,6 +15,7 @@ import (
 	"github.com/lytics/escp/esscroll"
 	"github.com/lytics/escp/estypes"
 	log "github.com/lytics/escp/logging"
+	"github.com/lytics/escp/pipeline"
 )
 
 var Client = http.DefaultClient
@@ -36,31 +35,74 @@ type Indexer struct {
 // closed when indexing is finished.
 func (i *Indexer) Err() chan error { return i.err }
 
-// New creates a new Elasticsearch bulk indexer. URL should be of the
-// form http://eshost:9200/_bulk.
-//
-// bufsz is the size of the upload buffer in kilobytes. bufsz < 1 will default
-// to 20mb.
-//
-// par is the number of parallel buffers to use. par < 1 will default to 3.
+// Config for a bulk Indexer.
+type Config struct {
+	Hosts   []string // hosts to send bulk requests to, of the form http://eshost:9200
+	Index   string   // index to write documents to
+	BufSize int      // size of the upload buffer; < 1 will default to 20mb
+	Par     int      // number of parallel upload buffers; < 1 will default to 3
+
+	// OnAck is called with the documents of a batch once every one of them
+	// has been acknowledged by Elasticsearch or written to DeadLetter.
+	// Optional.
+	OnAck func(docs []*estypes.Doc)
+
+	// OnLost is called instead of OnAck with the documents of a batch when
+	// some of them were dropped because there is no DeadLetter. Optional.
+	OnLost func(docs []*estypes.Doc)
+
+	// DeadLetter receives documents that failed permanently or still failed
+	// after all retries. Without one they are logged and dropped. Bulk
+	// requests that fail permanently as a whole, such as to a missing index,
+	// stop the Indexer instead. Optional.
+	DeadLetter *DeadLetterFile
+
+	// Retry classifies failures and limits retries; nil will default to
+	// DefaultRetryPolicy.
+	Retry *RetryPolicy
+
+	// Adaptive grows the upload buffer size and parallel uploads while
+	// uploads are fast, up to MaxBufSize and MaxPar, and shrinks them when
+	// Elasticsearch rejects requests or upload latency rises. BufSize and Par
+	// are the starting point.
+	Adaptive   bool
+	MaxBufSize int // < BufSize will default to 4*BufSize
+	MaxPar     int // < Par will default to 4*Par
+
+	LogEvery time.Duration // rate at which to log indexing progress; 0 disables
+
+	// VersionType, such as "external", indexes documents with their source
+	// version so the destination keeps the source's versions. Requires
+	// documents read with their version.
+	VersionType string
+
+	// Typeless leaves document types out of bulk actions, as required by
+	// Elasticsearch 7+.
+	Typeless bool
+}
+
+// New creates a new Elasticsearch bulk indexer.
 //
 // Sends to docs should select on Indexer.Err to prevent deadlocking in case of
 // indexer error.
-func New(ctx context.Context, hosts []string, index string, bufsz, par int, docs <-chan *estypes.Doc, logger log.Logger) *Indexer {
-	indexer := &Indexer{
-		docs: docs,
-		// buffer an error per parallel upload buffer
-		err: make(chan error, par),
-	}
-
+func New(ctx context.Context, cfg *Config, docs <-chan *estypes.Doc, logger log.Logger) *Indexer {
+	bufsz, par := cfg.BufSize, cfg.Par
 	if bufsz < 1 {
 		bufsz = 20 * 1024
 	}
 	if par < 1 {
 		par = 3
 	}
-	targets := make([]string, len(hosts))
-	for i, h := range hosts {
+
+	ctrl := newController(cfg, bufsz, par)
+	indexer := &Indexer{
+		docs: docs,
+		// buffer an error per parallel upload buffer
+		err: make(chan error, ctrl.maxPar+1),
+	}
+
+	targets := make([]string, len(cfg.Hosts))
+	for i, h := range cfg.Hosts {
 		targets[i] = fmt.Sprintf("%s/_bulk", h)
 	}
 	ti := 0
@@ -68,15 +110,15 @@ func New(ctx context.Context, hosts []string, index string, bufsz, par int, docs
 	go func() {
 		defer close(indexer.err)
 
-		uploadat := bufsz
-		if bufsz > 1000 {
-			// upload at 500kb less than buffer size to avoid buffer resizing
-			uploadat = bufsz - 500
+		if cfg.LogEvery > 0 {
+			logctx, can := context.WithCancel(ctx)
+			defer can()
+			go logProgress(logctx, cfg.LogEvery, ctrl, logger)
 		}
 
 		wg := new(sync.WaitGroup)
-		batchs := make(chan *Batch, par)
-		for i := 0; i < par; i++ {
+		batchs := make(chan *Batch, ctrl.maxPar)
+		for i := 0; i < ctrl.maxPar; i++ {
 			batchs <- NewBatch()
 		}
 
@@ -89,22 +131,32 @@ func New(ctx context.Context, hosts []string, index string, bufsz, par int, docs
 				batch = b
 			}
 
-			batch.Add(doc.ID, doc)
+			batch.Add(docKey(cfg, doc.Type, doc.ID), doc)
 			sz += len(doc.Source)
+			if doc.Delete {
+				sz += len(doc.ID) + 64 // deletes are only an action line
+			}
 
 			// Actually do the bulk insert once the buffer is full
-			if sz >= uploadat {
+			if sz >= ctrl.uploadAt() {
+				ctrl.acquire()
 				wg.Add(1)
 				go func(b *Batch, target string) {
 					defer wg.Done()
-					if b.Len() == 0 {
+					defer func() { batchs <- b }() // return the buffer to the pool even if the upload failed
+					n := b.Len()
+					defer func() { ctrl.release(n) }()
+					if n == 0 {
 						return
 					}
-					if err := upload(ctx, target, index, b, logger); err != nil {
-						indexer.err <- err
-						return
+					if err := upload(ctx, target, cfg, ctrl, b, logger); err != nil {
+						select {
+						case indexer.err <- err:
+						default:
+							// Err is full of earlier errors nobody has received
+							logger.Errorf("bulk upload failed: %v", err)
+						}
 					}
-					batchs <- b
 				}(batch, targets[ti])
 
 				sz = 0
@@ -113,7 +165,8 @@ func New(ctx context.Context, hosts []string, index string, bufsz, par int, docs
 			}
 			select {
 			case <-ctx.Done():
-				//TODO Save prgress
+				// let in-flight uploads finish so they're acknowledged
+				wg.Wait()
 				return
 			default:
 			}
@@ -122,35 +175,155 @@ func New(ctx context.Context, hosts []string, index string, bufsz, par int, docs
 		// No more docs, if the buffer is non-empty upload it
 		if batch != nil && batch.Len() > 0 {
 			ti = (ti + 1) % len(targets)
-			if err := upload(ctx, targets[ti], index, batch, logger); err != nil {
+			n := batch.Len()
+			ctrl.acquire()
+			if err := upload(ctx, targets[ti], cfg, ctrl, batch, logger); err != nil {
 				indexer.err <- err
 			}
+			ctrl.release(n)
 		}
 		wg.Wait() // wait for async uploads to complete too
+		if cfg.LogEvery > 0 {
+			logger.Infof("bulk indexing finished: %v", ctrl)
+		}
 	}()
 
 	return indexer
 }
 
-// upload buffer to bulk API.
-func upload(ctx context.Context, url, index string, batch *Batch, logger log.Logger) error {
+// split uploads the documents of batch in two halves, for requests that are
+// too large for Elasticsearch. Each half is acknowledged on its own.
+func split(ctx context.Context, url string, cfg *Config, ctrl *controller, batch *Batch, logger log.Logger) error {
+	keys := make([]string, 0, batch.Len())
+	for key := range batch.docs {
+		keys = append(keys, key)
+	}
+	for _, half := range [][]string{keys[:len(keys)/2], keys[len(keys)/2:]} {
+		b := NewBatch()
+		for _, key := range half {
+			b.docs[key] = batch.docs[key] // superseded documents stay with the one written
+		}
+		if err := upload(ctx, url, cfg, ctrl, b, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docKey is the key of a document in a Batch. Documents of different types
+// are different documents unless the destination is typeless.
+func docKey(cfg *Config, typ, id string) string {
+	if cfg.Typeless {
+		return id
+	}
+	return typ + "#" + id // types can't contain #
+}
+
+// requestError is the error of a bulk request that failed as a whole.
+func requestError(status int, body []byte) *ESError {
+	res := struct {
+		Error *ESError `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &res); err == nil && res.Error != nil {
+		return res.Error
+	}
+	return &ESError{Type: "bulk_request_failed", Reason: fmt.Sprintf("response code %d: %s", status, body)}
+}
+
+// logProgress logs the documents uploaded and the current upload settings
+// every logevery until ctx is done.
+func logProgress(ctx context.Context, logevery time.Duration, ctrl *controller, logger log.Logger) {
+	for {
+		select {
+		case <-time.After(logevery):
+			logger.Infof("bulk indexing progress: %v", ctrl)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sink writes documents to Elasticsearch with a bulk Indexer.
+type Sink struct {
+	cfg    *Config
+	logger log.Logger
+}
+
+var _ pipeline.Sink = (*Sink)(nil)
+
+// NewSink creates a Sink that starts a new Indexer for every Write.
+func NewSink(cfg *Config, logger log.Logger) *Sink {
+	return &Sink{cfg: cfg, logger: logger}
+}
+
+// Write docs with a new Indexer, returning its Err channel.
+func (s *Sink) Write(ctx context.Context, docs <-chan *estypes.Doc) <-chan error {
+	return New(ctx, s.cfg, docs, s.logger).Err()
+}
+
+// upload buffer to bulk API. Documents that can't be written are sent to the
+// dead-letter file. If every document is accounted for the documents are
+// passed to OnAck.
+func upload(ctx context.Context, url string, cfg *Config, ctrl *controller, batch *Batch, logger log.Logger) error {
 	st := time.Now()
+	policy := cfg.Retry
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	maxRetries := policy.maxRetries()
+	docs := batch.All()
+	lastErrs := map[string]*ESError{}
 	var lastFailedBrespErrs []*BulkResponse
 	errsString := func(br []*BulkResponse) string {
 		strs := []string{}
 		for _, b := range br {
+			if b.Error == nil {
+				strs = append(strs, fmt.Sprintf("%v->%v", b.Id, b.Status))
+				continue
+			}
 			strs = append(strs, fmt.Sprintf("%v->%v:%v", b.Id, b.Error.Type, b.Error.Reason))
 		}
 		return strings.Join(strs, ",")
 	}
 
-	for try := 0; try < 64; try++ {
+	// drop removes a document from the batch, writing it to the dead-letter
+	// file if there is one.
+	lost := 0
+	drop := func(doc *estypes.Doc) error {
+		key := docKey(cfg, doc.Type, doc.ID)
+		batch.Delete(key)
+		if cfg.DeadLetter == nil {
+			lost++
+			return nil
+		}
+		if err := cfg.DeadLetter.Write(doc, lastErrs[key]); err != nil {
+			return fmt.Errorf("esbulk.upload: %v", err)
+		}
+		return nil
+	}
+
+	// report passes docs, which are no longer in the batch, to OnAck, or to
+	// OnLost if any document of the batch was dropped.
+	report := func(docs []*estypes.Doc) {
+		if lost > 0 {
+			logger.Errorf("error: dropped %v docs without a dead-letter file", lost)
+			if cfg.OnLost != nil {
+				cfg.OnLost(docs)
+			}
+			return
+		}
+		if cfg.OnAck != nil {
+			cfg.OnAck(docs)
+		}
+	}
+
+	for try := 0; try < maxRetries; try++ {
 		select {
 		case <-ctx.Done():
 		default:
 		}
 
-		buf, err := batch.Encode(index)
+		buf, err := batch.Encode(cfg)
 		if err != nil {
 			return fmt.Errorf("esbulk.upload: error encoding batch: %v", err)
 		}
@@ -161,68 +334,148 @@ func upload(ctx context.Context, url, index string, batch *Batch, logger log.Log
 		}
 
 		if try > 10 {
-			logger.Warnf("slow upload warning: retry:%v of %v bytes:%v batchlen:%v runtime:%v errors:%v", try, 64, esscroll.IECFormat(uint64(len(buf))), batch.Len(), time.Since(st), errsString(lastFailedBrespErrs))
+			logger.Warnf("slow upload warning: retry:%v of %v bytes:%v batchlen:%v runtime:%v errors:%v", try, maxRetries, esscroll.IECFormat(uint64(len(buf))), batch.Len(), time.Since(st), errsString(lastFailedBrespErrs))
 		}
 
+		pst := time.Now()
 		resp, err := Client.Post(url, "application/json", bytes.NewReader(buf))
 		if err != nil {
 			logger.Warnf("esbulk.upload: error posting to ES: %v, bytes len: %d", err, len(buf))
 			backoff(try)
 			continue
 		}
-		if resp != nil {
-			defer resp.Body.Close()
-		}
 
 		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		if err != nil {
-			return fmt.Errorf("esbulk.upload: error reading response: %v", err)
+			logger.Warnf("esbulk.upload: error reading response: %v retry:%v", err, try)
+			backoff(try)
+			continue
 		}
 		if resp.StatusCode != 200 {
-			return fmt.Errorf("esbulk.upload: non-200 response code: %d", resp.StatusCode)
+			reqerr := requestError(resp.StatusCode, b)
+			class := policy.Classify(resp.StatusCode, reqerr)
+			ctrl.observe(time.Since(pst), len(buf), class == Throttled)
+			switch {
+			case resp.StatusCode == 413 && batch.Len() > 1:
+				logger.Warnf("esbulk.upload: request of %v too large; splitting the batch of %d docs", esscroll.IECFormat(uint64(len(buf))), batch.Len())
+				// the documents earlier tries took care of aren't part of either half
+				handled := []*estypes.Doc{}
+				for _, doc := range docs {
+					if batch.Get(docKey(cfg, doc.Type, doc.ID)) == nil {
+						handled = append(handled, doc)
+					}
+				}
+				if len(handled) > 0 {
+					report(handled)
+				}
+				return split(ctx, url, cfg, ctrl, batch, logger)
+			case class == Permanent && resp.StatusCode == 413:
+				// a single document too large to ever be indexed
+				logger.Errorf("esbulk.upload: doc too large with response code %d: %v:%v; dropping it",
+					resp.StatusCode, reqerr.Type, reqerr.Reason)
+				for _, doc := range batch.Docs() {
+					lastErrs[docKey(cfg, doc.Type, doc.ID)] = reqerr
+					if err := drop(doc); err != nil {
+						return err
+					}
+				}
+			case class == Permanent:
+				// Requests, such as to a missing index, that can never succeed
+				// would fail every batch the same way.
+				return fmt.Errorf("esbulk.upload: request failed permanently with response code %d: %v:%v",
+					resp.StatusCode, reqerr.Type, reqerr.Reason)
+			case class == Throttled:
+				logger.Warnf("esbulk.upload: throttled with response code: %d retry:%v", resp.StatusCode, try)
+				throttle(try)
+			default:
+				logger.Warnf("esbulk.upload: non-200 response code: %d retry:%v", resp.StatusCode, try)
+				backoff(try)
+			}
+			if batch.Len() == 0 {
+				break
+			}
+			continue
 		}
 		bresp := &BulkResponses{}
 		if err := json.Unmarshal(b, &bresp); err != nil {
-			return fmt.Errorf("esbulk.upload: error decoding response: %v", err)
+			logger.Warnf("esbulk.upload: error decoding response: %v retry:%v", err, try)
+			backoff(try)
+			continue
 		}
 		//log.Printf("BulkResponse successes: %d\n", len(bresp.Items))
 
 		ct := 0
-		const include404 = false
-		for _, successful := range bresp.Succeeded(include404) {
+		for _, successful := range bresp.Succeeded(false) {
 			// remove bulk successes from next try, so we only resent the
 			// failed docs.
-			batch.Delete(successful.Id)
+			batch.Delete(docKey(cfg, successful.Type, successful.Id))
 			ct++
 		}
+		for _, gone := range bresp.Gone() {
+			// deleting a document that's already gone succeeded too
+			batch.Delete(docKey(cfg, gone.Type, gone.Id))
+		}
 		if batch.Len() == 0 {
+			ctrl.observe(time.Since(pst), len(buf), false)
 			break
 		}
 
-		lastFailedBrespErrs = bresp.Failed(!include404)
+		lastFailedBrespErrs = bresp.Failed(false)
+		throttled := false
+		permanent := []*BulkResponse{}
+		for _, failed := range lastFailedBrespErrs {
+			key := docKey(cfg, failed.Type, failed.Id)
+			doc := batch.Get(key)
+			if doc == nil {
+				// already handled, such as a delete of a missing document
+				continue
+			}
+			if failed.Error != nil && failed.Error.Type == "index_not_found_exception" {
+				// every other document would fail the same way
+				return fmt.Errorf("esbulk.upload: %v:%v", failed.Error.Type, failed.Error.Reason)
+			}
+			if cfg.VersionType != "" && failed.Error != nil && failed.Error.Type == "version_conflict_engine_exception" {
+				// the destination already has this version or a newer one
+				batch.Delete(key)
+				continue
+			}
+			lastErrs[key] = failed.Error
+			switch policy.Classify(failed.Status, failed.Error) {
+			case Permanent:
+				// fail fast; retrying can't help
+				if err := drop(doc); err != nil {
+					return err
+				}
+				permanent = append(permanent, failed)
+			case Throttled:
+				throttled = true
+			}
+		}
+		if len(permanent) > 0 {
+			logger.Errorf("esbulk.upload: %d docs failed permanently: %v", len(permanent), errsString(permanent))
+		}
+		ctrl.observe(time.Since(pst), len(buf), throttled)
+		if batch.Len() == 0 {
+			break
+		}
 
-		backoff(try)
+		if throttled {
+			throttle(try)
+		} else {
+			backoff(try)
+		}
 	}
 
+	defer batch.Reset()
 	if batch.Len() > 0 {
 		logger.Errorf("error: unable to write all docs to ES for this batch: %v remaining items", batch.Len())
+		for _, doc := range batch.Docs() {
+			if err := drop(doc); err != nil {
+				return err
+			}
+		}
 	}
-	batch.Reset()
-
+	report(docs)
 	return nil
 }
-
-func backoff(try int) {
-	nf := math.Pow(2, float64(try))
-	nf = math.Max(1, nf)
-	if try < 3 {
-		nf = math.Min(nf, 2000)
-	} else if try > 10 {
-		nf = math.Min(nf, 8000)
-	} else {
-		nf = math.Min(nf, 4000)
-	}
-	r := rand.Int31n(int32(nf))
-	d := time.Duration(int32(try*100)+r) * time.Millisecond
-	time.Sleep(d)
-}
@@ -0,0 +1,121 @@
+package esbulk
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Class of a bulk indexing failure, which decides how it is retried.
+type Class int
+
+const (
+	// Retryable failures are retried with backoff.
+	Retryable Class = iota
+	// Throttled failures are pushback from the cluster and are retried after
+	// a longer backoff.
+	Throttled
+	// Permanent failures can never succeed and aren't retried.
+	Permanent
+)
+
+func (c Class) String() string {
+	switch c {
+	case Throttled:
+		return "throttled"
+	case Permanent:
+		return "permanent"
+	default:
+		return "retryable"
+	}
+}
+
+// RetryPolicy classifies bulk indexing failures by their status and error
+// type. Error types take precedence over statuses.
+type RetryPolicy struct {
+	MaxRetries int // attempts per batch; < 1 will default to 64
+
+	ThrottledStatus []int    // statuses of throttled failures
+	ThrottledTypes  []string // error types of throttled failures
+	PermanentStatus []int    // statuses of permanent failures
+	PermanentTypes  []string // error types of permanent failures
+}
+
+// DefaultRetryPolicy treats rejections as throttling and document and mapping
+// errors as permanent. Everything else is retried.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxRetries:      64,
+		ThrottledStatus: []int{429, 503},
+		ThrottledTypes: []string{
+			"es_rejected_execution_exception",
+			"circuit_breaking_exception",
+		},
+		PermanentStatus: []int{400, 404, 405, 409, 413},
+		PermanentTypes: []string{
+			"mapper_parsing_exception",
+			"document_parsing_exception",
+			"strict_dynamic_mapping_exception",
+			"illegal_argument_exception",
+			"action_request_validation_exception",
+			"version_conflict_engine_exception",
+		},
+	}
+}
+
+// Classify a failure with the given status and error, which may be nil.
+func (p *RetryPolicy) Classify(status int, eserr *ESError) Class {
+	if eserr != nil {
+		for _, t := range p.ThrottledTypes {
+			if eserr.Type == t {
+				return Throttled
+			}
+		}
+		for _, t := range p.PermanentTypes {
+			if eserr.Type == t {
+				return Permanent
+			}
+		}
+	}
+	for _, s := range p.ThrottledStatus {
+		if status == s {
+			return Throttled
+		}
+	}
+	for _, s := range p.PermanentStatus {
+		if status == s {
+			return Permanent
+		}
+	}
+	return Retryable
+}
+
+func (p *RetryPolicy) maxRetries() int {
+	if p.MaxRetries < 1 {
+		return 64
+	}
+	return p.MaxRetries
+}
+
+func backoff(try int) {
+	nf := math.Pow(2, float64(try))
+	nf = math.Max(1, nf)
+	if try < 3 {
+		nf = math.Min(nf, 2000)
+	} else if try > 10 {
+		nf = math.Min(nf, 8000)
+	} else {
+		nf = math.Min(nf, 4000)
+	}
+	r := rand.Int31n(int32(nf))
+	d := time.Duration(int32(try*100)+r) * time.Millisecond
+	time.Sleep(d)
+}
+
+// throttle backs off longer than backoff to give an overloaded cluster time to
+// drain its queues; from 1s doubling up to 30s, plus jitter.
+func throttle(try int) {
+	d := time.Second * time.Duration(math.Min(30, math.Pow(2, float64(try))))
+	d += time.Duration(rand.Int63n(int64(d / 2)))
+	time.Sleep(d)
+}
@@ -0,0 +1,50 @@
+package esbulk
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	custom := &RetryPolicy{
+		ThrottledStatus: []int{503},
+		PermanentTypes:  []string{"my_exception"},
+	}
+	tests := []struct {
+		name   string
+		policy *RetryPolicy
+		status int
+		errtyp string // type of the error; none if ""
+		want   Class
+	}{
+		{name: "ok", status: 200, want: Retryable},
+		{name: "server error", status: 500, want: Retryable},
+		{name: "unavailable", status: 503, want: Throttled},
+		{name: "too many requests", status: 429, want: Throttled},
+		{name: "rejected", status: 429, errtyp: "es_rejected_execution_exception", want: Throttled},
+		{name: "circuit breaker", status: 500, errtyp: "circuit_breaking_exception", want: Throttled},
+		{name: "bad request", status: 400, want: Permanent},
+		{name: "not found", status: 404, want: Permanent},
+		{name: "conflict", status: 409, want: Permanent},
+		{name: "too large", status: 413, want: Permanent},
+		{name: "mapping", status: 400, errtyp: "mapper_parsing_exception", want: Permanent},
+		{name: "strict mapping", status: 400, errtyp: "strict_dynamic_mapping_exception", want: Permanent},
+		{name: "type before status", status: 400, errtyp: "es_rejected_execution_exception", want: Throttled},
+		{name: "unknown type", status: 500, errtyp: "some_exception", want: Retryable},
+		{name: "unknown type, permanent status", status: 400, errtyp: "some_exception", want: Permanent},
+		{name: "custom throttled", policy: custom, status: 503, want: Throttled},
+		{name: "custom default status", policy: custom, status: 429, want: Retryable},
+		{name: "custom permanent", policy: custom, status: 500, errtyp: "my_exception", want: Permanent},
+		{name: "custom default type", policy: custom, status: 400, errtyp: "mapper_parsing_exception", want: Retryable},
+	}
+	for _, tc := range tests {
+		p := tc.policy
+		if p == nil {
+			p = DefaultRetryPolicy()
+		}
+		var eserr *ESError
+		if tc.errtyp != "" {
+			eserr = &ESError{Type: tc.errtyp}
+		}
+		if c := p.Classify(tc.status, eserr); c != tc.want {
+			t.Errorf("%s: %v; expected %v", tc.name, c, tc.want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package esdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lytics/escp/estypes"
+)
+
+// Kinds of Changes.
+const (
+	ChangeAdded   = "added"   // the path is only in the destination
+	ChangeRemoved = "removed" // the path is only in the source
+	ChangeChanged = "changed" // the path's value differs
+)
+
+// Diff describes how the destination differs from the source.
+type Diff struct {
+	ID      string    `json:"id,omitempty"`      // the document's _id
+	Type    string    `json:"type,omitempty"`    // the document's _type
+	Routing string    `json:"routing,omitempty"` // the document's routing, if any
+	Kind    string    `json:"kind"`              // DiffMissing, DiffExtra, DiffSource or DiffCount
+	Changes []*Change `json:"changes,omitempty"` // if DiffSource or DiffCount, what changed
+}
+
+// docDiff returns a Diff of kind for doc.
+func docDiff(doc *estypes.Doc, kind string) *Diff {
+	return &Diff{ID: doc.ID, Type: doc.Type, Routing: doc.RoutingKey(), Kind: kind}
+}
+
+// Doc returns the metadata of the differing document.
+func (d *Diff) Doc() *estypes.Doc {
+	return &estypes.Doc{Meta: estypes.Meta{ID: d.ID, Type: d.Type, Routing: d.Routing}}
+}
+
+func (d *Diff) String() string {
+	switch d.Kind {
+	case DiffMissing:
+		return fmt.Sprintf("MissingDoc:%v", d.ID)
+	case DiffExtra:
+		return fmt.Sprintf("ExtraDoc:%v", d.ID)
+	case DiffCount:
+		if len(d.Changes) == 1 {
+			return fmt.Sprintf("DocCountMissMatch: %v vs. %v", d.Changes[0].Old, d.Changes[0].New)
+		}
+		return "DocCountMissMatch"
+	}
+	changes := make([]string, len(d.Changes))
+	for i, c := range d.Changes {
+		changes[i] = c.String()
+	}
+	return fmt.Sprintf("DocMissMatch:%v %s", d.ID, strings.Join(changes, "; "))
+}
+
+// Change to the value at a JSON path of a document, such as user.tags[1].
+type Change struct {
+	Path string      `json:"path"`
+	Kind string      `json:"kind"`          // ChangeAdded, ChangeRemoved or ChangeChanged
+	Old  interface{} `json:"old,omitempty"` // the source's value, unless added
+	New  interface{} `json:"new,omitempty"` // the destination's value, unless removed
+}
+
+func (c *Change) String() string {
+	switch c.Kind {
+	case ChangeAdded:
+		return fmt.Sprintf("added %s=%s", c.Path, jsonString(c.New))
+	case ChangeRemoved:
+		return fmt.Sprintf("removed %s=%s", c.Path, jsonString(c.Old))
+	default:
+		return fmt.Sprintf("changed %s %s -> %s", c.Path, jsonString(c.Old), jsonString(c.New))
+	}
+}
+
+// jsonString formats a value as JSON so strings can be told from numbers.
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// diffSources returns the changes from the src to the dst document source
+// that rules don't allow.
+func diffSources(src, dst json.RawMessage, rules *Rules) ([]*Change, error) {
+	origsrc, err := decode(src)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling source doc: %v", err)
+	}
+	newsrc, err := decode(dst)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling destination doc: %v", err)
+	}
+	changes := []*Change{}
+	diffValues("", "", origsrc, newsrc, rules, &changes)
+	return changes, nil
+}
+
+// decode JSON keeping numbers as written.
+func decode(b json.RawMessage) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// diffValues appends the changes from a to b at path to changes, descending
+// into objects and arrays. field is path without array positions, which rules
+// are matched against.
+func diffValues(path, field string, a, b interface{}, rules *Rules, changes *[]*Change) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p, f := k, k
+			if path != "" {
+				p = path + "." + k
+			}
+			if field != "" {
+				f = field + "." + k
+			}
+			if rules.ignored(f) {
+				continue
+			}
+			aval, aok := av[k]
+			bval, bok := bv[k]
+			if rules.nullIsMissing() && (!aok && bval == nil || !bok && aval == nil) {
+				continue
+			}
+			switch {
+			case !bok:
+				*changes = append(*changes, &Change{Path: p, Kind: ChangeRemoved, Old: aval})
+			case !aok:
+				*changes = append(*changes, &Change{Path: p, Kind: ChangeAdded, New: bval})
+			default:
+				diffValues(p, f, aval, bval, rules, changes)
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if rules.unordered(field) {
+			diffSets(path, field, av, bv, rules, changes)
+			return
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			p := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(bv):
+				*changes = append(*changes, &Change{Path: p, Kind: ChangeRemoved, Old: av[i]})
+			case i >= len(av):
+				*changes = append(*changes, &Change{Path: p, Kind: ChangeAdded, New: bv[i]})
+			default:
+				diffValues(p, field, av[i], bv[i], rules, changes)
+			}
+		}
+		return
+	case json.Number:
+		if bv, ok := b.(json.Number); ok && (numbersEqual(av, bv) || tolerated(field, av, bv, rules)) {
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, &Change{Path: path, Kind: ChangeChanged, Old: a, New: b})
+	}
+}
+
+// diffSets appends the elements of a that aren't in b as removed and those of
+// b that aren't in a as added, ignoring their order. Elements are equal if
+// diffValues finds no changes between them, so numbers are compared by value
+// and rules apply within them.
+func diffSets(path, field string, a, b []interface{}, rules *Rules, changes *[]*Change) {
+	amatched, bmatched := make([]bool, len(a)), make([]bool, len(b))
+
+	// pair identical elements first, by their canonical JSON
+	unmatched := make(map[string][]int, len(b))
+	for i, v := range b {
+		k := jsonString(canonicalNumbers(v))
+		unmatched[k] = append(unmatched[k], i)
+	}
+	for i, v := range a {
+		k := jsonString(canonicalNumbers(v))
+		if pos := unmatched[k]; len(pos) > 0 {
+			unmatched[k] = pos[1:]
+			amatched[i], bmatched[pos[0]] = true, true
+		}
+	}
+
+	// then elements that only differ in ways rules allow
+	if rules != nil {
+		for i, av := range a {
+			if amatched[i] {
+				continue
+			}
+			for j, bv := range b {
+				if bmatched[j] {
+					continue
+				}
+				elemChanges := []*Change{}
+				diffValues(path, field, av, bv, rules, &elemChanges)
+				if len(elemChanges) == 0 {
+					amatched[i], bmatched[j] = true, true
+					break
+				}
+			}
+		}
+	}
+
+	for i, v := range a {
+		if !amatched[i] {
+			*changes = append(*changes, &Change{Path: path + "[" + strconv.Itoa(i) + "]", Kind: ChangeRemoved, Old: v})
+		}
+	}
+	for i, v := range b {
+		if !bmatched[i] {
+			*changes = append(*changes, &Change{Path: path + "[" + strconv.Itoa(i) + "]", Kind: ChangeAdded, New: v})
+		}
+	}
+}
+
+// canonicalNumbers returns v with its numbers written the same way whenever
+// their values are equal, so 1 and 1.0 encode alike.
+func canonicalNumbers(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case json.Number:
+		if i, err := vv.Int64(); err == nil {
+			return json.Number(strconv.FormatInt(i, 10))
+		}
+		if f, err := vv.Float64(); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, e := range vv {
+			m[k] = canonicalNumbers(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(vv))
+		for i, e := range vv {
+			l[i] = canonicalNumbers(e)
+		}
+		return l
+	}
+	return v
+}
+
+// tolerated returns true if the numbers are within the tolerance rules allow
+// at field.
+func tolerated(field string, a, b json.Number, rules *Rules) bool {
+	af, aerr := a.Float64()
+	bf, berr := b.Float64()
+	return aerr == nil && berr == nil && rules.tolerated(field, af, bf)
+}
+
+// numbersEqual compares numbers by value, so 1 and 1.0 are equal.
+func numbersEqual(a, b json.Number) bool {
+	if a == b {
+		return true
+	}
+	if ai, err := a.Int64(); err == nil {
+		if bi, err := b.Int64(); err == nil {
+			return ai == bi
+		}
+	}
+	af, aerr := a.Float64()
+	bf, berr := b.Float64()
+	return aerr == nil && berr == nil && af == bf
+}
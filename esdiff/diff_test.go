@@ -0,0 +1,54 @@
+package esdiff
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// changeStrings formats changes as Diff.String does.
+func changeStrings(changes []*Change) string {
+	out := make([]string, len(changes))
+	for i, c := range changes {
+		out[i] = c.String()
+	}
+	return strings.Join(out, "; ")
+}
+
+func TestDiffSources(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst string
+		changes  string // the changes, as formatted by Diff.String
+	}{
+		{name: "equal", src: `{"a":1,"b":"x"}`, dst: `{"b":"x","a":1}`},
+		{name: "empty", src: `{}`, dst: `{}`},
+		{name: "numbers by value", src: `{"a":1,"b":1.0,"c":1e3}`, dst: `{"a":1.0,"b":1,"c":1000}`},
+		{name: "number not string", src: `{"a":"1"}`, dst: `{"a":1}`, changes: `changed a "1" -> 1`},
+		{name: "changed", src: `{"a":"x"}`, dst: `{"a":"y"}`, changes: `changed a "x" -> "y"`},
+		{name: "added", src: `{}`, dst: `{"a":null}`, changes: `added a=null`},
+		{name: "removed", src: `{"a":{"b":true}}`, dst: `{}`, changes: `removed a={"b":true}`},
+		{name: "nested", src: `{"a":{"b":{"c":1}}}`, dst: `{"a":{"b":{"c":2}}}`, changes: `changed a.b.c 1 -> 2`},
+		{name: "object replaced", src: `{"a":{"b":1}}`, dst: `{"a":[1]}`, changes: `changed a {"b":1} -> [1]`},
+		{name: "array shortened", src: `{"a":[1,2,3]}`, dst: `{"a":[1,2]}`, changes: `removed a[2]=3`},
+		{name: "array lengthened", src: `{"a":[1]}`, dst: `{"a":[1,2]}`, changes: `added a[1]=2`},
+		{name: "array reordered", src: `{"a":[1,2]}`, dst: `{"a":[2,1]}`, changes: `changed a[0] 1 -> 2; changed a[1] 2 -> 1`},
+		{name: "objects in arrays", src: `{"a":[{"b":1}]}`, dst: `{"a":[{"b":2}]}`, changes: `changed a[0].b 1 -> 2`},
+		{
+			name:    "sorted by path",
+			src:     `{"c":1,"a":1,"b":{"z":1,"y":1}}`,
+			dst:     `{"c":2,"b":{"z":2,"x":1}}`,
+			changes: `removed a=1; added b.x=1; removed b.y=1; changed b.z 1 -> 2; changed c 1 -> 2`,
+		},
+	}
+	for _, tc := range tests {
+		changes, err := diffSources(json.RawMessage(tc.src), json.RawMessage(tc.dst), nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if s := changeStrings(changes); s != tc.changes {
+			t.Errorf("%s: changes %q; expected %q", tc.name, s, tc.changes)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package esdiff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/lytics/escp/estypes"
+)
+
+// DiffExtra is returned for destination documents that aren't in the source.
+const DiffExtra = "extra"
+
+// DigestStats of a CompareSorted.
+type DigestStats struct {
+	Source      int // source documents compared
+	Destination int // destination documents compared
+	Buckets     int // buckets compared
+	Differing   int // buckets whose digests differed
+}
+
+func (s *DigestStats) String() string {
+	return fmt.Sprintf("source=%d destination=%d buckets=%d differing=%d", s.Source, s.Destination, s.Buckets, s.Differing)
+}
+
+// CompareSorted compares every document of two streams sorted by _id. The
+// source stream is cut into buckets of about bucketsz documents and the
+// destination documents within the same range of ids are put in the same
+// bucket. Documents with the same _id are always in the same bucket, and are
+// told apart by their type unless typeless. Buckets are compared by a digest
+// of their ids and canonicalized sources, and only the documents of buckets
+// that differ are compared one by one, applying rules. Since digests are
+// exact, differences rules allow still cause their buckets' documents to be
+// compared.
+//
+// report is called with the diff of every differing document: DiffMissing
+// for source documents missing from the destination, DiffExtra for
+// destination documents that aren't in the source, or how the sources differ.
+// Streams that aren't sorted by _id, or repeat a document, fail like they do
+// for a SortedReader.
+func CompareSorted(src, dst <-chan *estypes.Doc, bucketsz int, typeless bool, rules *Rules, report func(diff *Diff)) (*DigestStats, error) {
+	if bucketsz < 1 {
+		bucketsz = 1000
+	}
+	stats := &DigestStats{}
+	sr, dr := chanReader("source", true, src), chanReader("destination", !typeless, dst)
+	dgroup, err := dr.Group()
+	if err != nil {
+		return stats, err
+	}
+	for {
+		var sgroups [][]*estypes.Doc
+		for n := 0; n < bucketsz; {
+			sgroup, err := sr.Group()
+			if err != nil {
+				return stats, err
+			}
+			if sgroup == nil {
+				break
+			}
+			sgroups = append(sgroups, sgroup)
+			n += len(sgroup)
+		}
+		if len(sgroups) == 0 {
+			break
+		}
+		last := sgroups[len(sgroups)-1][0].ID
+		var dgroups [][]*estypes.Doc
+		for dgroup != nil && dgroup[0].ID <= last {
+			dgroups = append(dgroups, dgroup)
+			if dgroup, err = dr.Group(); err != nil {
+				return stats, err
+			}
+		}
+		if err := compareBucket(sgroups, dgroups, typeless, rules, stats, report); err != nil {
+			return stats, err
+		}
+	}
+
+	// anything left sorts after the last source document
+	for dgroup != nil {
+		for _, doc := range dgroup {
+			stats.Destination++
+			report(docDiff(doc, DiffExtra))
+		}
+		if dgroup, err = dr.Group(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// compareBucket compares the digests of a bucket of groups of documents with
+// the same _id and if they differ its documents.
+func compareBucket(sgroups, dgroups [][]*estypes.Doc, typeless bool, rules *Rules, stats *DigestStats, report func(*Diff)) error {
+	stats.Buckets++
+	ns, nd := 0, 0
+	for _, group := range sgroups {
+		ns += len(group)
+	}
+	for _, group := range dgroups {
+		nd += len(group)
+	}
+	stats.Source += ns
+	stats.Destination += nd
+	if ns == nd {
+		sd, err := digest(sgroups, typeless)
+		if err != nil {
+			return err
+		}
+		dd, err := digest(dgroups, typeless)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(sd, dd) {
+			return nil
+		}
+	}
+	stats.Differing++
+
+	// drill down by merging the sorted groups
+	i, j := 0, 0
+	for i < len(sgroups) || j < len(dgroups) {
+		switch {
+		case j == len(dgroups) || i < len(sgroups) && sgroups[i][0].ID < dgroups[j][0].ID:
+			for _, doc := range sgroups[i] {
+				report(docDiff(doc, DiffMissing))
+			}
+			i++
+		case i == len(sgroups) || dgroups[j][0].ID < sgroups[i][0].ID:
+			for _, doc := range dgroups[j] {
+				report(docDiff(doc, DiffExtra))
+			}
+			j++
+		default:
+			if err := compareGroup(sgroups[i], dgroups[j], typeless, rules, report); err != nil {
+				return err
+			}
+			i++
+			j++
+		}
+	}
+	return nil
+}
+
+// compareGroup compares source and destination documents with the same _id,
+// pairing them by type unless typeless.
+func compareGroup(srcs, dsts []*estypes.Doc, typeless bool, rules *Rules, report func(*Diff)) error {
+	paired := make([]bool, len(dsts))
+	for _, sdoc := range srcs {
+		k := -1
+		for j, ddoc := range dsts {
+			if !paired[j] && (typeless || ddoc.Type == sdoc.Type) {
+				k = j
+				break
+			}
+		}
+		if k < 0 {
+			report(docDiff(sdoc, DiffMissing))
+			continue
+		}
+		paired[k] = true
+		diff, err := compare(sdoc, dsts[k], typeless, rules)
+		if err != nil {
+			return err
+		}
+		if diff != nil {
+			report(diff)
+		}
+	}
+	for j, ddoc := range dsts {
+		if !paired[j] {
+			report(docDiff(ddoc, DiffExtra))
+		}
+	}
+	return nil
+}
+
+// digest hashes the ids, types unless typeless, and canonicalized sources of
+// groups.
+func digest(groups [][]*estypes.Doc, typeless bool) ([]byte, error) {
+	h := sha256.New()
+	for _, docs := range groups {
+		if !typeless && len(docs) > 1 {
+			// the types of an _id are read in no particular order
+			docs = append([]*estypes.Doc{}, docs...)
+			sort.Slice(docs, func(i, j int) bool { return docs[i].Type < docs[j].Type })
+		}
+		for _, doc := range docs {
+			src, err := canonical(doc.Source)
+			if err != nil {
+				return nil, fmt.Errorf("error canonicalizing document %s: %v", doc.ID, err)
+			}
+			h.Write([]byte(doc.ID))
+			h.Write([]byte{0})
+			if !typeless {
+				h.Write([]byte(doc.Type))
+				h.Write([]byte{0})
+			}
+			h.Write(src)
+			h.Write([]byte{0})
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// canonical re-encodes a source with its object keys sorted and whitespace
+// removed, keeping numbers as written.
+func canonical(source json.RawMessage) ([]byte, error) {
+	if len(source) == 0 {
+		return nil, nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(source))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,139 @@
+package esdiff
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lytics/escp/estypes"
+)
+
+// docStream sends documents parsed from "type/id" or "id" strings, optionally
+// followed by "=" and their source, which defaults to {}.
+func docStream(specs ...string) <-chan *estypes.Doc {
+	ch := make(chan *estypes.Doc, len(specs))
+	for _, spec := range specs {
+		doc := &estypes.Doc{Source: json.RawMessage(`{}`)}
+		if parts := strings.SplitN(spec, "=", 2); len(parts) == 2 {
+			spec, doc.Source = parts[0], json.RawMessage(parts[1])
+		}
+		if parts := strings.SplitN(spec, "/", 2); len(parts) == 2 {
+			doc.Type, doc.ID = parts[0], parts[1]
+		} else {
+			doc.ID = spec
+		}
+		ch <- doc
+	}
+	close(ch)
+	return ch
+}
+
+func TestCompareSorted(t *testing.T) {
+	tests := []struct {
+		name      string
+		src, dst  []string
+		bucketsz  int
+		typeless  bool
+		rules     *Rules
+		diffs     []string // kind:id of the diffs reported
+		buckets   int
+		differing int
+		err       string // substring of the expected error
+	}{
+		{name: "empty", bucketsz: 2},
+		{name: "equal", src: []string{"a", "b", "c", "d", "e"}, dst: []string{"a", "b", "c", "d", "e"}, bucketsz: 2, buckets: 3},
+		{name: "empty destination", src: []string{"a", "b", "c"}, bucketsz: 2, diffs: []string{"missing:a", "missing:b", "missing:c"}, buckets: 2, differing: 2},
+		{name: "empty source", dst: []string{"a", "b"}, bucketsz: 2, diffs: []string{"extra:a", "extra:b"}},
+		{name: "extra after the last bucket", src: []string{"a", "b"}, dst: []string{"a", "b", "c"}, bucketsz: 2, diffs: []string{"extra:c"}, buckets: 1},
+		{name: "extra before the first bucket", src: []string{"b", "c"}, dst: []string{"a", "b", "c"}, bucketsz: 2, diffs: []string{"extra:a"}, buckets: 1, differing: 1},
+		{
+			name: "extra at a bucket edge", bucketsz: 2,
+			src: []string{"a", "b", "d", "e"}, dst: []string{"a", "b", "c", "d", "e"},
+			diffs: []string{"extra:c"}, buckets: 2, differing: 1,
+		},
+		{
+			name: "missing at a bucket edge", bucketsz: 2,
+			src: []string{"a", "b", "c", "d"}, dst: []string{"a", "c", "d"},
+			diffs: []string{"missing:b"}, buckets: 2, differing: 1,
+		},
+		{
+			name: "equal counts, different ids", bucketsz: 2,
+			src: []string{"a", "b"}, dst: []string{"a", "c"},
+			diffs: []string{"missing:b", "extra:c"}, buckets: 1, differing: 1,
+		},
+		{
+			name: "source differs", bucketsz: 2,
+			src: []string{"a", `b={"n":1}`, "c"}, dst: []string{"a", `b={"n":2}`, "c"},
+			diffs: []string{"source differs:b"}, buckets: 2, differing: 1,
+		},
+		{
+			name: "canonical sources", bucketsz: 2,
+			src: []string{`a={"x":1,"y":[1,2]}`}, dst: []string{`a={"y":[1,2], "x":1}`},
+			buckets: 1,
+		},
+		{
+			name: "difference allowed by rules", bucketsz: 2, rules: &Rules{Ignore: []string{"n"}},
+			src: []string{`a={"n":1}`}, dst: []string{`a={"n":2}`},
+			buckets: 1, differing: 1,
+		},
+		{
+			name: "types of an id in one bucket", bucketsz: 1,
+			src: []string{"t1/a", "t2/a", "t1/b"}, dst: []string{"t2/a", "t1/a", "t1/b"},
+			buckets: 2,
+		},
+		{
+			name: "bucket overfilled by the types of an id", bucketsz: 2,
+			src: []string{"t1/a", "t1/b", "t2/b", "t1/c"}, dst: []string{"t1/a", "t1/b", "t2/b", "t1/c"},
+			buckets: 2,
+		},
+		{
+			name: "type differs", bucketsz: 2,
+			src: []string{"t1/a"}, dst: []string{"t2/a"},
+			diffs: []string{"missing:a", "extra:a"}, buckets: 1, differing: 1,
+		},
+		{
+			name: "typeless", bucketsz: 2, typeless: true,
+			src: []string{"t1/a", "t1/b"}, dst: []string{"_doc/a", "_doc/b"},
+			buckets: 1,
+		},
+		{
+			name: "unsorted source", bucketsz: 2,
+			src: []string{"b", "a"}, dst: []string{"a", "b"},
+			err: `source isn't sorted by _id: "a" read after "b"`,
+		},
+		{
+			name: "repeated destination", bucketsz: 2, typeless: true,
+			src: []string{"a", "b"}, dst: []string{"a", "a", "b"},
+			err: `destination has document "a"`,
+		},
+	}
+	for _, tc := range tests {
+		diffs := []string{}
+		stats, err := CompareSorted(docStream(tc.src...), docStream(tc.dst...), tc.bucketsz, tc.typeless, tc.rules, func(d *Diff) {
+			diffs = append(diffs, d.Kind+":"+d.ID)
+		})
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error %q but got: %v", tc.name, tc.err, err)
+		}
+		if tc.err != "" {
+			continue
+		}
+		want := tc.diffs
+		if want == nil {
+			want = []string{}
+		}
+		if !reflect.DeepEqual(diffs, want) {
+			t.Errorf("%s: diffs %v != %v", tc.name, diffs, want)
+		}
+		if stats.Buckets != tc.buckets || stats.Differing != tc.differing {
+			t.Errorf("%s: %d buckets, %d differing; expected %d, %d", tc.name, stats.Buckets, stats.Differing, tc.buckets, tc.differing)
+		}
+		if stats.Source != len(tc.src) || stats.Destination != len(tc.dst) {
+			t.Errorf("%s: compared %d/%d documents; expected %d/%d", tc.name, stats.Source, stats.Destination, len(tc.src), len(tc.dst))
+		}
+	}
+}
@@ -6,8 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"reflect"
+	"net/url"
 
+	"github.com/lytics/escp/esindex"
 	"github.com/lytics/escp/estypes"
 	log "github.com/lytics/escp/logging"
 )
@@ -20,6 +21,10 @@ const (
 	// DiffSource is returned if the source document and destination document
 	// sources differ.
 	DiffSource = "source differs"
+
+	// DiffCount is used for differing document counts of the source and
+	// destination indexes.
+	DiffCount = "count differs"
 )
 
 // ErrHTTP is returned for non-200 responses from the destination Elasticsearch
@@ -33,29 +38,40 @@ func (e *ErrHTTP) Error() string {
 	return fmt.Sprintf("non-200 status code: %d", e.Code)
 }
 
-// Check the source document against the destination URL. Returns a string
-// describing any differences or any empty string if the documents matched.
+// Check the source document against the destination URL. Returns a Diff
+// describing any differences or nil if the documents matched.
+//
+// If typeless the destination is Elasticsearch 7+, so the document is fetched
+// as _doc and its type isn't compared. Differences rules allow are ignored;
+// nil rules compare the sources exactly.
 //
 // Errors from Elasticsearch or JSON unmarshalling are returned untouched
-// with an empty diff string.
-func Check(src *estypes.Doc, dst string, logger log.Logger) (diff string, err error) {
+// with a nil diff.
+func Check(src *estypes.Doc, dst string, typeless bool, rules *Rules, logger log.Logger) (diff *Diff, err error) {
 	// Get the document from the target index
-	target := fmt.Sprintf("%s/%s/%s", dst, src.Type, src.ID)
+	doctype := src.Type
+	if typeless {
+		doctype = "_doc"
+	}
+	target := fmt.Sprintf("%s/%s/%s", dst, doctype, url.PathEscape(src.ID))
+	if routing := src.RoutingKey(); routing != "" {
+		target += "?routing=" + url.QueryEscape(routing)
+	}
 	resp, err := http.Get(target)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	switch resp.StatusCode {
 	case 200:
 		// continue on
 	case 404:
 		// treat as diff
-		return DiffMissing, nil
+		return docDiff(src, DiffMissing), nil
 	default:
 		// treat all other respones as errors
 		buf, _ := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
-		return "", &ErrHTTP{resp.StatusCode, buf}
+		return nil, &ErrHTTP{resp.StatusCode, buf}
 	}
 
 	if resp.StatusCode != 200 {
@@ -66,39 +82,57 @@ func Check(src *estypes.Doc, dst string, logger log.Logger) (diff string, err er
 		logger.Errorf("unable to unmarshal json body: Url:%s Err:%v", target, err)
 		ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
-		return "", fmt.Errorf("error decoding destination document: %v", err)
+		return nil, fmt.Errorf("error decoding destination document: %v", err)
 	}
+	return compare(src, &newdoc, typeless, rules)
+}
 
+// CheckBatch checks the source documents against the destination index URL
+// with a single _mget request. Returns a diff for every source document, as
+// Check would.
+func CheckBatch(srcs []*estypes.Doc, dst string, typeless bool, rules *Rules, logger log.Logger) ([]*Diff, error) {
+	dsts, err := esindex.MultiGet(dst, srcs, typeless)
+	if err != nil {
+		return nil, err
+	}
+	diffs := make([]*Diff, len(srcs))
+	for i, src := range srcs {
+		if dsts[i] == nil {
+			diffs[i] = docDiff(src, DiffMissing)
+			continue
+		}
+		if diffs[i], err = compare(src, dsts[i], typeless, rules); err != nil {
+			return nil, err
+		}
+	}
+	return diffs, nil
+}
+
+// compare a source document with the destination's copy of it.
+func compare(src, newdoc *estypes.Doc, typeless bool, rules *Rules) (*Diff, error) {
 	if src.ID != newdoc.ID {
-		return "", fmt.Errorf("metadata mismatch; document _id %s != %s", src.ID, newdoc.ID)
+		return nil, fmt.Errorf("metadata mismatch; document _id %s != %s", src.ID, newdoc.ID)
 	}
-	if src.Type != newdoc.Type {
-		return "", fmt.Errorf("metadata mismatch; document type %s != %s", src.Type, newdoc.Type)
+	if !typeless && src.Type != newdoc.Type {
+		return nil, fmt.Errorf("metadata mismatch; document type %s != %s", src.Type, newdoc.Type)
 	}
 
 	// Fast path
 	if bytes.Equal(src.Source, newdoc.Source) {
-		return "", nil
+		return nil, nil
 	}
 
 	// Slow path
-	origsrc := map[string]interface{}{}
-	if err := json.Unmarshal(src.Source, &origsrc); err != nil {
-		return "", fmt.Errorf("error unmarshalling source doc: %v", err)
-	}
-	newsrc := make(map[string]interface{}, len(origsrc))
-	if err := json.Unmarshal(newdoc.Source, &newsrc); err != nil {
-		return "", fmt.Errorf("error unmarshalling destination doc: %v", err)
-	}
-
-	if len(origsrc) != len(newsrc) {
-		return fmt.Sprintf("%d fields in source; %d fields in target", src.ID, len(origsrc), len(newsrc)), nil
+	changes, err := diffSources(src.Source, newdoc.Source, rules)
+	if err != nil {
+		return nil, err
 	}
-
-	if !reflect.DeepEqual(origsrc, newsrc) {
-		return DiffSource, nil
+	if len(changes) > 0 {
+		diff := docDiff(src, DiffSource)
+		diff.Changes = changes
+		return diff, nil
 	}
 
 	// We're good!
-	return "", nil
+	return nil, nil
 }
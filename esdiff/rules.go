@@ -0,0 +1,102 @@
+package esdiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// Rules relaxing how document sources are compared, for copies that
+// legitimately differ such as those passed through an ingest pipeline.
+//
+// Paths are field names as Elasticsearch sees them: object keys joined by
+// dots, ignoring array positions, so user.tags.name matches the name of every
+// object in the user.tags array. A nil *Rules compares sources exactly.
+type Rules struct {
+	Ignore        []string           `json:"ignore,omitempty"`          // paths whose values, and everything under them, aren't compared; a "*" segment matches any key, as in *.updated_at
+	Tolerance     map[string]float64 `json:"tolerance,omitempty"`       // largest absolute difference allowed between the numbers at each path; "*" applies to every number
+	Unordered     []string           `json:"unordered,omitempty"`       // paths of arrays compared as sets, ignoring order; "*" applies to every array
+	NullIsMissing bool               `json:"null_is_missing,omitempty"` // treat a null field and a missing field as equal
+}
+
+// LoadRules reads Rules from a JSON file.
+func LoadRules(fn string) (*Rules, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file: %v", err)
+	}
+	r := &Rules{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("error decoding rules file %s: %v", fn, err)
+	}
+	return r, nil
+}
+
+func (r *Rules) ignored(field string) bool {
+	if r == nil {
+		return false
+	}
+	for _, p := range r.Ignore {
+		if matchPath(p, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rules) unordered(field string) bool {
+	if r == nil {
+		return false
+	}
+	return contains(r.Unordered, field) || contains(r.Unordered, "*")
+}
+
+func (r *Rules) nullIsMissing() bool {
+	return r != nil && r.NullIsMissing
+}
+
+// tolerated returns true if the numbers at field are within its tolerance.
+func (r *Rules) tolerated(field string, a, b float64) bool {
+	if r == nil {
+		return false
+	}
+	tol, ok := r.Tolerance[field]
+	if !ok {
+		if tol, ok = r.Tolerance["*"]; !ok {
+			return false
+		}
+	}
+	return math.Abs(a-b) <= tol
+}
+
+// matchPath returns true if field matches pattern, whose "*" segments match
+// any key.
+func matchPath(pattern, field string) bool {
+	if pattern == field {
+		return true
+	}
+	if !strings.Contains(pattern, "*") {
+		return false
+	}
+	psegs, fsegs := strings.Split(pattern, "."), strings.Split(field, ".")
+	if len(psegs) != len(fsegs) {
+		return false
+	}
+	for i, seg := range psegs {
+		if seg != "*" && seg != fsegs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(paths []string, field string) bool {
+	for _, p := range paths {
+		if p == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package esdiff
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    *Rules
+		src, dst string
+		changes  string // the changes, as formatted by Diff.String
+	}{
+		{name: "nil rules", src: `{"a":[1,2]}`, dst: `{"a":[2,1]}`, changes: `changed a[0] 1 -> 2; changed a[1] 2 -> 1`},
+		{name: "ignored", rules: &Rules{Ignore: []string{"a"}}, src: `{"a":1,"b":1}`, dst: `{"a":2,"b":1}`},
+		{name: "ignored added", rules: &Rules{Ignore: []string{"a"}}, src: `{}`, dst: `{"a":{"b":1}}`},
+		{name: "ignored under", rules: &Rules{Ignore: []string{"a"}}, src: `{"a":{"b":1}}`, dst: `{"a":{"b":2}}`},
+		{name: "ignored in arrays", rules: &Rules{Ignore: []string{"a.t"}}, src: `{"a":[{"t":1,"x":1}]}`, dst: `{"a":[{"t":2,"x":1}]}`},
+		{name: "ignored prefix only", rules: &Rules{Ignore: []string{"a"}}, src: `{"ab":1}`, dst: `{"ab":2}`, changes: `changed ab 1 -> 2`},
+		{name: "ignored wildcard", rules: &Rules{Ignore: []string{"*.t"}}, src: `{"a":{"t":1},"b":{"t":1}}`, dst: `{"a":{"t":2},"b":{"t":2}}`},
+		{name: "ignored wildcard segment", rules: &Rules{Ignore: []string{"a.*.t"}}, src: `{"a":{"b":{"t":1,"x":1}}}`, dst: `{"a":{"b":{"t":2,"x":2}}}`, changes: `changed a.b.x 1 -> 2`},
+		{name: "wildcard one segment", rules: &Rules{Ignore: []string{"*.t"}}, src: `{"t":1,"a":{"b":{"t":1}}}`, dst: `{"t":2,"a":{"b":{"t":2}}}`, changes: `changed a.b.t 1 -> 2; changed t 1 -> 2`},
+		{name: "tolerance", rules: &Rules{Tolerance: map[string]float64{"p": 0.01}}, src: `{"p":1.001,"q":1.001}`, dst: `{"p":1.002,"q":1.002}`, changes: `changed q 1.001 -> 1.002`},
+		{name: "tolerance exceeded", rules: &Rules{Tolerance: map[string]float64{"p": 0.01}}, src: `{"p":1}`, dst: `{"p":1.5}`, changes: `changed p 1 -> 1.5`},
+		{name: "tolerance wildcard", rules: &Rules{Tolerance: map[string]float64{"*": 1}}, src: `{"p":1,"o":{"q":[1]}}`, dst: `{"p":2,"o":{"q":[0.5]}}`},
+		{name: "tolerance numbers only", rules: &Rules{Tolerance: map[string]float64{"*": 1}}, src: `{"p":"1"}`, dst: `{"p":"2"}`, changes: `changed p "1" -> "2"`},
+		{name: "unordered", rules: &Rules{Unordered: []string{"a"}}, src: `{"a":[1,2,2],"b":[1,2]}`, dst: `{"a":[2,1,2],"b":[1,2]}`},
+		{name: "unordered counts", rules: &Rules{Unordered: []string{"a"}}, src: `{"a":[1,2,2]}`, dst: `{"a":[1,1,2]}`, changes: `removed a[2]=2; added a[1]=1`},
+		{name: "unordered changed", rules: &Rules{Unordered: []string{"a"}}, src: `{"a":["x","y"]}`, dst: `{"a":["z","x"]}`, changes: `removed a[1]="y"; added a[0]="z"`},
+		{name: "unordered numbers by value", rules: &Rules{Unordered: []string{"a"}}, src: `{"a":[1,2.0,{"b":1}]}`, dst: `{"a":[{"b":1.0},2,1.0]}`},
+		{name: "unordered wildcard", rules: &Rules{Unordered: []string{"*"}}, src: `{"a":[1,2],"b":{"c":[3,4]}}`, dst: `{"a":[2,1],"b":{"c":[4,3]}}`},
+		{
+			name:  "unordered with rules within",
+			rules: &Rules{Unordered: []string{"a"}, Ignore: []string{"a.t"}, Tolerance: map[string]float64{"a.p": 0.1}},
+			src:   `{"a":[{"t":1,"p":1},{"t":2,"p":5}]}`,
+			dst:   `{"a":[{"t":3,"p":5.05},{"t":4,"p":1}]}`,
+		},
+		{name: "null is missing", rules: &Rules{NullIsMissing: true}, src: `{"a":null,"b":1}`, dst: `{"b":1,"c":null}`},
+		{name: "null is not a value", rules: &Rules{NullIsMissing: true}, src: `{"a":null}`, dst: `{"a":1}`, changes: `changed a null -> 1`},
+	}
+	for _, tc := range tests {
+		changes, err := diffSources(json.RawMessage(tc.src), json.RawMessage(tc.dst), tc.rules)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if s := changeStrings(changes); s != tc.changes {
+			t.Errorf("%s: changes %q; expected %q", tc.name, s, tc.changes)
+		}
+	}
+}
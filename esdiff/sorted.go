@@ -0,0 +1,95 @@
+package esdiff
+
+import (
+	"fmt"
+
+	"github.com/lytics/escp/estypes"
+)
+
+// SortedReader reads the documents of a stream sorted by _id in groups with
+// the same _id, failing if the stream isn't sorted or repeats a document.
+type SortedReader struct {
+	name  string
+	next  func() (*estypes.Doc, error) // returns nil at the end of the stream
+	typed bool                         // ids may repeat with different types
+
+	n    int // documents read
+	peek *estypes.Doc
+	last string
+	done bool
+}
+
+// NewSortedReader reads the stream called name from next, which returns nil
+// at its end. If typed, documents with the same _id and different types are
+// grouped together instead of failing as repeated.
+func NewSortedReader(name string, typed bool, next func() (*estypes.Doc, error)) *SortedReader {
+	return &SortedReader{name: name, next: next, typed: typed}
+}
+
+// chanReader is a SortedReader of the documents received from docs.
+func chanReader(name string, typed bool, docs <-chan *estypes.Doc) *SortedReader {
+	return NewSortedReader(name, typed, func() (*estypes.Doc, error) {
+		return <-docs, nil
+	})
+}
+
+// N returns the number of documents read.
+func (r *SortedReader) N() int { return r.n }
+
+// Typed reports whether ids may repeat with different types.
+func (r *SortedReader) Typed() bool { return r.typed }
+
+// Group returns the next documents with the same _id, or nil at the end.
+func (r *SortedReader) Group() ([]*estypes.Doc, error) {
+	if r.peek == nil && !r.done {
+		if err := r.read(); err != nil {
+			return nil, err
+		}
+	}
+	if r.peek == nil {
+		return nil, nil
+	}
+	group := []*estypes.Doc{r.peek}
+	r.last = r.peek.ID
+	for {
+		// check the document after the group too, so it's only used once
+		// it's known to be followed by a larger id
+		if err := r.read(); err != nil {
+			return nil, err
+		}
+		if r.peek != nil && r.peek.ID < r.last {
+			return nil, fmt.Errorf("%s isn't sorted by _id: %q read after %q", r.name, r.peek.ID, r.last)
+		}
+		if r.peek == nil || r.peek.ID != r.last {
+			return group, nil
+		}
+		if !r.typed || HasType(group, r.peek.Type) {
+			return nil, fmt.Errorf("%s has document %q of type %q more than once", r.name, r.peek.ID, r.peek.Type)
+		}
+		group = append(group, r.peek)
+	}
+}
+
+func (r *SortedReader) read() error {
+	doc, err := r.next()
+	if err != nil {
+		return err
+	}
+	r.peek = doc
+	if doc == nil {
+		r.done = true
+		return nil
+	}
+	r.n++
+	return nil
+}
+
+// HasType reports whether any of docs has type typ.
+func HasType(docs []*estypes.Doc, typ string) bool {
+	for _, doc := range docs {
+		if doc.Type == typ {
+			return true
+		}
+	}
+	return false
+}
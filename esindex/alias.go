@@ -0,0 +1,117 @@
+package esindex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/lytics/escp/estypes"
+)
+
+// AliasAction is a single action of an update to aliases. Exactly one of Add
+// or Remove should be set.
+type AliasAction struct {
+	Add    *AliasTarget `json:"add,omitempty"`
+	Remove *AliasTarget `json:"remove,omitempty"`
+}
+
+// AliasTarget is an alias and the index it points to.
+type AliasTarget struct {
+	Index string `json:"index"`
+	Alias string `json:"alias"`
+}
+
+// GetAlias returns the indices alias points to on the cluster at host, which
+// should be of the form http://host:port. A missing alias points to no
+// indices.
+func GetAlias(host, alias string) ([]string, error) {
+	uri := fmt.Sprintf("%s/_alias/%s", host, alias)
+	resp, err := http.Get(uri)
+	if err != nil {
+		return nil, fmt.Errorf("GetAlias::Uri:%v err:%v", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GetAlias::Error reading response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GetAlias::Uri:%v Non-200 status code: %d body:%s", uri, resp.StatusCode, string(b))
+	}
+	indices := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &indices); err != nil {
+		return nil, fmt.Errorf("GetAlias::error decoding response: err:%v body:%v", err, string(b))
+	}
+	names := []string{}
+	for name := range indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// UpdateAliases applies actions atomically on the cluster at host.
+func UpdateAliases(host string, actions []*AliasAction) error {
+	buf, err := json.Marshal(map[string][]*AliasAction{"actions": actions})
+	if err != nil {
+		return fmt.Errorf("error encoding alias actions: %v", err)
+	}
+	uri := host + "/_aliases"
+	resp, err := http.Post(uri, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("error updating aliases: (POST %v) error:%v", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("non-200 status code updating aliases: %d body:%s", resp.StatusCode, string(b))
+	}
+	ackr := estypes.AckResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&ackr); err != nil {
+		return fmt.Errorf("error decoding alias response: %v", err)
+	}
+	if !ackr.Ack {
+		return estypes.ErrUnack
+	}
+	return nil
+}
+
+// AddAlias points alias at index in addition to any indices it already
+// points to.
+func AddAlias(host, index, alias string) error {
+	return UpdateAliases(host, []*AliasAction{{Add: &AliasTarget{Index: index, Alias: alias}}})
+}
+
+// RemoveAlias stops alias from pointing at index.
+func RemoveAlias(host, index, alias string) error {
+	return UpdateAliases(host, []*AliasAction{{Remove: &AliasTarget{Index: index, Alias: alias}}})
+}
+
+// SwapAlias atomically moves alias from the indices it currently points to
+// onto index, so searches against the alias never see both or neither.
+// Returns the indices the alias was moved from.
+func SwapAlias(host, alias, index string) ([]string, error) {
+	from, err := GetAlias(host, alias)
+	if err != nil {
+		return nil, err
+	}
+	actions := []*AliasAction{{Add: &AliasTarget{Index: index, Alias: alias}}}
+	moved := []string{}
+	for _, old := range from {
+		if old == index {
+			continue
+		}
+		actions = append(actions, &AliasAction{Remove: &AliasTarget{Index: old, Alias: alias}})
+		moved = append(moved, old)
+	}
+	if err := UpdateAliases(host, actions); err != nil {
+		return nil, err
+	}
+	return moved, nil
+}
@@ -14,7 +14,9 @@ import (
 
 // Metadata describing an Elasticsearch index.
 type Meta struct {
-	Settings *Settings `json:"settings"`
+	Settings *Settings       `json:"settings"`
+	Mappings json.RawMessage `json:"mappings,omitempty"`
+	Aliases  json.RawMessage `json:"aliases,omitempty"`
 }
 
 // Settings for an Elasticsearch index.
@@ -30,6 +32,7 @@ type IndexSettings struct {
 	CompoundFormat  bool              `json:"compound_format,omitempty"`
 	Mapping         *IndexMapping     `json:"mapping,omitempty"`
 	Unassigned      *UnassignedWarper `json:"unassigned,omitempty"`
+	Analysis        json.RawMessage   `json:"analysis,omitempty"`
 }
 
 type IndexMapping struct {
@@ -104,16 +107,86 @@ func Get(dst string) (*Meta, error) {
 	return idxmeta, nil
 }
 
+// GetDocCount uses the _count endpoint, since searches on Elasticsearch 7+
+// stop counting at 10000 hits.
 func GetDocCount(idx string) (uint64, error) {
-	hresp, err := http.Get(idx + "/_search?size=0")
+	hresp, err := http.Get(idx + "/_count")
 	if err != nil {
 		return 0, fmt.Errorf("error contacting index:%v err:%v", idx, err)
 	}
-	newres := estypes.Results{}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != 200 {
+		return 0, fmt.Errorf("non-200 status code from index:%v: %d", idx, hresp.StatusCode)
+	}
+	newres := struct {
+		Count uint64 `json:"count"`
+	}{}
 	if err := json.NewDecoder(hresp.Body).Decode(&newres); err != nil {
 		return 0, fmt.Errorf("error reading target index:%v err:%v", idx, err)
 	}
-	return newres.Hits.Total, nil
+	return newres.Count, nil
+}
+
+// GetMax returns the largest value of field in the index, formatted as the
+// field's values are if it has a format such as a date's, or nil if no
+// document has the field.
+func GetMax(idx, field string) (json.RawMessage, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"max": map[string]interface{}{"max": map[string]string{"field": field}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(idx+"/_search", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error contacting index:%v err:%v", idx, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("non-200 status code from index:%v: %d body:%s", idx, resp.StatusCode, string(b))
+	}
+	res := struct {
+		Aggs struct {
+			Max struct {
+				Value         json.RawMessage `json:"value"`
+				ValueAsString string          `json:"value_as_string"`
+			} `json:"max"`
+		} `json:"aggregations"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("error reading index:%v err:%v", idx, err)
+	}
+	max := res.Aggs.Max
+	switch {
+	case len(max.Value) == 0 || string(max.Value) == "null":
+		return nil, nil
+	case max.ValueAsString != "":
+		return json.Marshal(max.ValueAsString)
+	default:
+		return max.Value, nil
+	}
+}
+
+// GetVersion of the cluster at host, which should be of the form
+// http://host:port.
+func GetVersion(host string) (estypes.Version, error) {
+	resp, err := http.Get(host + "/")
+	if err != nil {
+		return estypes.Version{}, fmt.Errorf("error contacting host:%v err:%v", host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return estypes.Version{}, fmt.Errorf("non-200 status code from host:%v: %d", host, resp.StatusCode)
+	}
+	info := estypes.Info{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return estypes.Version{}, fmt.Errorf("error reading host:%v info err:%v", host, err)
+	}
+	return estypes.ParseVersion(info.Version.Number)
 }
 
 // Update index metadata
@@ -121,6 +194,20 @@ func Update(dst string, m *Meta) error {
 	return put(dst+"/_settings", m)
 }
 
+// Refresh the index so all documents written to it are searchable.
+func Refresh(dst string) error {
+	uri := dst + "/_refresh"
+	resp, err := http.Post(uri, "text/plain", nil)
+	if err != nil {
+		return fmt.Errorf("error refreshing: (POST %v) error:%v", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non-2xx status code: %d uri:%v", resp.StatusCode, uri)
+	}
+	return nil
+}
+
 func put(dst string, m *Meta) error {
 	buf, err := json.Marshal(m)
 	if err != nil {
@@ -0,0 +1,81 @@
+package esindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Health of an index as returned by the _cluster/health endpoint.
+type Health struct {
+	Status             string `json:"status"`
+	TimedOut           bool   `json:"timed_out"`
+	ActiveShards       int    `json:"active_shards"`
+	RelocatingShards   int    `json:"relocating_shards"`
+	InitializingShards int    `json:"initializing_shards"`
+	UnassignedShards   int    `json:"unassigned_shards"`
+}
+
+func (h *Health) String() string {
+	return fmt.Sprintf("status:%s active:%d relocating:%d initializing:%d unassigned:%d",
+		h.Status, h.ActiveShards, h.RelocatingShards, h.InitializingShards, h.UnassignedShards)
+}
+
+// WaitForHealth blocks until the index at dst, of the form
+// http://host:port/indexname, has at least status ("green", "yellow" or
+// "red") or timeout elapses.
+func WaitForHealth(dst, status string, timeout time.Duration) error {
+	u, err := url.Parse(dst)
+	if err != nil {
+		return fmt.Errorf("error parsing index url %v: %v", dst, err)
+	}
+	index := strings.Trim(u.Path, "/")
+	deadline := time.Now().Add(timeout)
+	for {
+		// Elasticsearch waits for the status itself; ask in short rounds so
+		// connections aren't held open for the whole timeout.
+		wait := time.Until(deadline)
+		if wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		uri := fmt.Sprintf("%s://%s/_cluster/health/%s?wait_for_status=%s&timeout=%ds", u.Scheme, u.Host, index, status, int(wait.Seconds()))
+		h, err := getHealth(uri)
+		if err != nil {
+			return err
+		}
+		if !h.TimedOut {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("index %s not %s after %v: %v", index, status, timeout, h)
+		}
+	}
+}
+
+func getHealth(uri string) (*Health, error) {
+	resp, err := http.Get(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error getting health: (GET %v) error:%v", uri, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading health: uri:%v error:%v", uri, err)
+	}
+	// timeouts are returned as 408 Request Timeout with the health as usual
+	if resp.StatusCode != 200 && resp.StatusCode != 408 {
+		return nil, fmt.Errorf("non-200 status code: %d uri:%v", resp.StatusCode, uri)
+	}
+	h := &Health{}
+	if err := json.Unmarshal(b, h); err != nil {
+		return nil, fmt.Errorf("error decoding health: uri:%v error:%v", uri, err)
+	}
+	return h, nil
+}
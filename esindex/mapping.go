@@ -0,0 +1,120 @@
+package esindex
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// mappingParams are the top level keys of a typeless mapping. Anything else at
+// the top level is a mapping type.
+var mappingParams = map[string]bool{
+	"properties":           true,
+	"dynamic":              true,
+	"dynamic_templates":    true,
+	"dynamic_date_formats": true,
+	"date_detection":       true,
+	"numeric_detection":    true,
+	"runtime":              true,
+	"enabled":              true,
+	"_source":              true,
+	"_routing":             true,
+	"_meta":                true,
+	"_field_names":         true,
+	"_all":                 true,
+	"_size":                true,
+}
+
+// removedTypeParams are mapping type parameters of Elasticsearch < 7 that 7+
+// rejects and that can be left out without changing the documents indexed.
+var removedTypeParams = []string{"_all", "_timestamp", "_ttl"}
+
+// MappingTypes returns the names of the mapping types of mappings, or none if
+// they are typeless.
+func MappingTypes(mappings json.RawMessage) ([]string, error) {
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(mappings, &m); err != nil {
+		return nil, fmt.Errorf("error decoding mappings: %v", err)
+	}
+	types := []string{}
+	for k := range m {
+		if mappingParams[k] {
+			return nil, nil
+		}
+		types = append(types, k)
+	}
+	return types, nil
+}
+
+// Typeless returns the mappings of a single mapping type without the type, as
+// Elasticsearch 7+ expects them. Typeless mappings are returned as is.
+//
+// The parameters of Elasticsearch < 7 that 7+ rejects, _all, _timestamp, _ttl
+// and the include_in_all of fields, are removed. Mappings with a _parent
+// can't be converted since 7+ models parents with a join field instead.
+func Typeless(mappings json.RawMessage) (json.RawMessage, error) {
+	types, err := MappingTypes(mappings)
+	if err != nil {
+		return nil, err
+	}
+	switch len(types) {
+	case 0:
+		return mappings, nil
+	case 1:
+		m := map[string]map[string]json.RawMessage{}
+		if err := json.Unmarshal(mappings, &m); err != nil {
+			return nil, fmt.Errorf("error decoding mappings: %v", err)
+		}
+		tm := m[types[0]]
+		if _, ok := tm["_parent"]; ok {
+			return nil, fmt.Errorf("cannot remove mapping type %s with a _parent; Elasticsearch 7+ needs a join field instead", types[0])
+		}
+		for _, param := range removedTypeParams {
+			delete(tm, param)
+		}
+		if props, ok := tm["properties"]; ok {
+			if tm["properties"], err = removeIncludeInAll(props); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(tm)
+	default:
+		return nil, fmt.Errorf("cannot remove mapping types from mappings with %d types: %v", len(types), types)
+	}
+}
+
+// removeIncludeInAll removes include_in_all from the fields of props and their
+// object and multi-fields.
+func removeIncludeInAll(props json.RawMessage) (json.RawMessage, error) {
+	fields := map[string]map[string]json.RawMessage{}
+	if err := json.Unmarshal(props, &fields); err != nil {
+		return nil, fmt.Errorf("error decoding mapping properties: %v", err)
+	}
+	for _, field := range fields {
+		delete(field, "include_in_all")
+		for _, sub := range []string{"properties", "fields"} {
+			if p, ok := field[sub]; ok {
+				var err error
+				if field[sub], err = removeIncludeInAll(p); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// Typed returns typeless mappings under the _doc type, as Elasticsearch < 7
+// expects them. Typed mappings are returned as is.
+func Typed(mappings json.RawMessage) (json.RawMessage, error) {
+	types, err := MappingTypes(mappings)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) > 0 || len(mappings) == 0 {
+		return mappings, nil
+	}
+	return json.Marshal(map[string]json.RawMessage{"_doc": mappings})
+}
@@ -0,0 +1,69 @@
+package esindex
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTypelessMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings string
+		want     string
+		err      string // substring of the expected error
+	}{
+		{name: "empty"},
+		{name: "one type", mappings: `{"doc":{"properties":{"a":{"type":"keyword"}}}}`, want: `{"properties":{"a":{"type":"keyword"}}}`},
+		{name: "already typeless", mappings: `{"properties":{"a":{"type":"keyword"}}}`, want: `{"properties":{"a":{"type":"keyword"}}}`},
+		{name: "typeless dynamic only", mappings: `{"dynamic":"strict"}`, want: `{"dynamic":"strict"}`},
+		{
+			name:     "removed parameters",
+			mappings: `{"doc":{"_all":{"enabled":false},"_timestamp":{},"_ttl":{},"dynamic":"strict","properties":{}}}`,
+			want:     `{"dynamic":"strict","properties":{}}`,
+		},
+		{
+			name:     "include_in_all",
+			mappings: `{"doc":{"properties":{"a":{"type":"text","include_in_all":false,"fields":{"raw":{"type":"keyword","include_in_all":true}}},"o":{"properties":{"b":{"type":"long","include_in_all":false}}}}}}`,
+			want:     `{"properties":{"a":{"fields":{"raw":{"type":"keyword"}},"type":"text"},"o":{"properties":{"b":{"type":"long"}}}}}`,
+		},
+		{name: "routing kept", mappings: `{"doc":{"_routing":{"required":true}}}`, want: `{"_routing":{"required":true}}`},
+		{name: "parent", mappings: `{"child":{"_parent":{"type":"parent"},"properties":{}}}`, err: "with a _parent"},
+		{name: "several types", mappings: `{"a":{},"b":{}}`, err: "mappings with 2 types"},
+		{name: "invalid", mappings: `[]`, err: "error decoding mappings"},
+	}
+	for _, tc := range tests {
+		m, err := Typeless(json.RawMessage(tc.mappings))
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error %q but got: %v", tc.name, tc.err, err)
+		case string(m) != tc.want:
+			t.Errorf("%s: %s; expected %s", tc.name, m, tc.want)
+		}
+	}
+}
+
+func TestTypedMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings string
+		want     string
+	}{
+		{name: "empty"},
+		{name: "typeless", mappings: `{"dynamic":"strict","properties":{}}`, want: `{"_doc":{"dynamic":"strict","properties":{}}}`},
+		{name: "already typed", mappings: `{"doc":{"properties":{}}}`, want: `{"doc":{"properties":{}}}`},
+		{name: "several types", mappings: `{"a":{},"b":{}}`, want: `{"a":{},"b":{}}`},
+	}
+	for _, tc := range tests {
+		m, err := Typed(json.RawMessage(tc.mappings))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if string(m) != tc.want {
+			t.Errorf("%s: %s; expected %s", tc.name, m, tc.want)
+		}
+	}
+}
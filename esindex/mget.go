@@ -0,0 +1,77 @@
+package esindex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/lytics/escp/estypes"
+)
+
+// mgetDoc identifies a document to get with _mget.
+type mgetDoc struct {
+	ID      string `json:"_id"`
+	Type    string `json:"_type,omitempty"`
+	Routing string `json:"routing,omitempty"`
+}
+
+// mgetResult is a document returned by _mget.
+type mgetResult struct {
+	estypes.Doc
+	Found bool            `json:"found"`
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// MultiGet the documents in the index at idx with the ids, types and routing
+// of docs using a single _mget request. The documents are returned in the
+// same order, with nil for those that weren't found. If typeless the index is
+// on Elasticsearch 7+ and the types of docs are ignored.
+func MultiGet(idx string, docs []*estypes.Doc, typeless bool) ([]*estypes.Doc, error) {
+	req := struct {
+		Docs []mgetDoc `json:"docs"`
+	}{Docs: make([]mgetDoc, len(docs))}
+	for i, doc := range docs {
+		req.Docs[i] = mgetDoc{ID: doc.ID, Routing: doc.RoutingKey()}
+		if !typeless {
+			req.Docs[i].Type = doc.Type
+		}
+	}
+	buf, err := json.Marshal(&req)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding mget request: %v", err)
+	}
+
+	uri := idx + "/_mget"
+	resp, err := http.Post(uri, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("error getting documents: (POST %v) error:%v", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("non-200 status code: %d uri:%v body:%s", resp.StatusCode, uri, string(b))
+	}
+	res := struct {
+		Docs []*mgetResult `json:"docs"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("error decoding mget response: %v", err)
+	}
+	if len(res.Docs) != len(docs) {
+		return nil, fmt.Errorf("mget returned %d documents for %d requested", len(res.Docs), len(docs))
+	}
+
+	found := make([]*estypes.Doc, len(docs))
+	for i, r := range res.Docs {
+		if len(r.Error) > 0 {
+			return nil, fmt.Errorf("error getting document %s: %s", docs[i].ID, string(r.Error))
+		}
+		if r.Found {
+			d := r.Doc
+			found[i] = &d
+		}
+	}
+	return found, nil
+}
@@ -13,28 +13,41 @@ import (
 
 	"github.com/lytics/escp/estypes"
 	log "github.com/lytics/escp/logging"
+	"github.com/lytics/escp/pipeline"
 )
 
 var Client = http.DefaultClient
 
-type Response struct {
-	Total uint64
-	Hits  <-chan *estypes.Doc
-
-	mu  *sync.Mutex
-	err error
+// HitMeta selects optional metadata to return with search results.
+type HitMeta struct {
+	Version        bool // return _version
+	SeqNo          bool // return _seq_no and _primary_term; requires ES 6.7+
+	TrackTotalHits bool // count every hit for Response.Total; requires ES 7+, which otherwise stops at 10000
+	NoSource       bool // leave out _source when only the metadata is needed
 }
 
-func (r *Response) setErr(err error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.err = err
+// apply adds the selected metadata to a search request body.
+func (h HitMeta) apply(req map[string]interface{}) {
+	if h.Version {
+		req["version"] = true
+	}
+	if h.SeqNo {
+		req["seq_no_primary_term"] = true
+	}
+	if h.TrackTotalHits {
+		req["track_total_hits"] = true
+	}
+	if h.NoSource {
+		req["_source"] = false
+	}
 }
 
-func (r *Response) Err() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	return r.err
+// Cursor is the position of a single scroll. It can be passed to Continue to
+// pick the scroll back up as long as it hasn't expired on the server; see
+// ESScoll.Cursors for which hits a continuation returns.
+type Cursor struct {
+	ScrollID string `json:"scroll_id"`
+	Pages    int    `json:"pages"` // pages sent to Response.Hits so far
 }
 
 type ESScoll struct {
@@ -44,11 +57,22 @@ type ESScoll struct {
 	buflen  int
 	filter  map[string]interface{}
 
+	mu      sync.Mutex
+	cursors []Cursor
+
+	// Slices is the number of sliced scrolls to run concurrently. Their hits
+	// are merged into a single Response. Values < 2 use a single scroll.
+	Slices int
+
+	HitMeta
+
 	logevery time.Duration
 	logger   log.Logger
 	ctx      context.Context
 }
 
+var _ pipeline.Source = (*ESScoll)(nil)
+
 func New(ctx context.Context, indexUrl string, timeout time.Duration, pagesz, buflen int, filter map[string]interface{}, logevery time.Duration, logger log.Logger) *ESScoll {
 	surl := indexUrl + "/_search"
 	tout := fmt.Sprintf("%ds", int(timeout.Seconds()))
@@ -64,31 +88,138 @@ func New(ctx context.Context, indexUrl string, timeout time.Duration, pagesz, bu
 	}
 }
 
+// Continue an already started scroll from its cursors, as returned by
+// ESScoll.Cursors. URL should be of the form http://host:port/indexname.
+// The page size and filter of the original scroll are kept by Elasticsearch.
+func Continue(ctx context.Context, indexUrl string, timeout time.Duration, buflen int, cursors []Cursor, logevery time.Duration, logger log.Logger) *ESScoll {
+	s := New(ctx, indexUrl, timeout, 0, buflen, nil, logevery, logger)
+	s.cursors = cursors
+	s.Slices = len(cursors)
+	return s
+}
+
 // Start a new scroll. URL should be of the form http://host:port/indexname.
 //
+// When Slices > 1 a scroll is opened per slice and all of them are read
+// concurrently. Response.Total is the sum of the totals of every slice.
+//
 // When Response.Hits is closed, Response.Err() should be checked to see if the
 // scroll completed successfully or not.
-func (s *ESScoll) Start() (*Response, error) {
+func (s *ESScoll) Start() (*pipeline.Response, error) {
 	origurl, err := url.Parse(s.surl)
 	if err != nil {
 		return nil, err
 	}
+	baseurl := origurl.Scheme + "://" + origurl.Host + "/_search/scroll"
+
+	slices := max(1, s.Slices)
+	firsts := make([]*estypes.Results, slices)
+	cursors := make([]Cursor, slices)
+	var total uint64
+	for i := range firsts {
+		var result *estypes.Results
+		if s.cursors != nil {
+			result, err = s.next(baseurl, s.cursors[i].ScrollID)
+			cursors[i].Pages = s.cursors[i].Pages
+		} else {
+			result, err = s.open(i, slices)
+		}
+		if err != nil {
+			if s.cursors == nil {
+				// the slices opened so far would be kept alive until they expire
+				s.clear(baseurl, firsts[:i])
+			}
+			return nil, err
+		}
+		firsts[i] = result
+		cursors[i].ScrollID = result.ScrollID
+		total += uint64(result.Hits.Total)
+	}
+
+	s.mu.Lock()
+	s.cursors = cursors
+	s.mu.Unlock()
+
+	out := make(chan *estypes.Doc, s.buflen) // each result will actually get pagesz*shards documents
+	r := pipeline.NewResponse(total, out)
+
+	go func() {
+		defer close(out)
+		ctx, can := context.WithCancel(s.ctx)
+		defer can()
+		prog := NewProgress(s.logevery, s.logger)
+		prog.Start(ctx)
+		prog.SetDocCount(r.Total)
+
+		//TODO the array of docs all the way into esbulk
+		scrollwg := &sync.WaitGroup{}
+		for i, result := range firsts {
+			scrollwg.Add(1)
+			go func(slice int, result *estypes.Results) {
+				defer scrollwg.Done()
+				if err := s.scroll(ctx, baseurl, slice, result, out, prog); err != nil {
+					r.SetErr(err)
+					can() // stop the other slices
+				}
+			}(i, result)
+		}
+		scrollwg.Wait()
+	}()
+
+	return r, nil
+}
+
+// Cursors returns the current position of every slice of the scroll.
+//
+// A cursor is the scroll's state on the server, not a position in the hits:
+// continuing it always fetches the page after the last one the server
+// returned. A slice only fetches its next page once every hit of the previous
+// one was sent to Response.Hits, so a continuation picks up after the hits
+// sent so far. Hits that were sent but not processed by the receiver before
+// it stopped are never returned again, and neither are the hits of the page
+// that was being sent when ctx was done.
+func (s *ESScoll) Cursors() []Cursor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cursors := make([]Cursor, len(s.cursors))
+	copy(cursors, s.cursors)
+	return cursors
+}
+
+func (s *ESScoll) advanceCursor(slice int, scrollID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursors[slice].ScrollID = scrollID
+	s.cursors[slice].Pages++
+}
+
+// open the scroll for slice id of n slices and return the first page of
+// results.
+func (s *ESScoll) open(id, n int) (*estypes.Results, error) {
 	searchurl := fmt.Sprintf("%s?scroll=%s&size=%d", s.surl, s.timeout, s.pagesz)
 
+	req := map[string]interface{}{}
+	if s.filter != nil {
+		req["query"] = map[string]interface{}{
+			"bool": map[string]interface{}{"filter": s.filter},
+		}
+	}
+	if n > 1 {
+		req["slice"] = map[string]int{"id": id, "max": n}
+	}
+	s.HitMeta.apply(req)
+
 	var resp *http.Response
-	if s.filter == nil {
-		resp, err = http.DefaultClient.Get(searchurl)
+	var err error
+	if len(req) == 0 {
+		resp, err = Client.Get(searchurl)
 	} else {
-		req := struct {
-			Filter map[string]interface{} `json:"filter"`
-		}{s.filter}
-		body, err := json.Marshal(req)
-		if err != nil {
+		var body []byte
+		if body, err = json.Marshal(req); err != nil {
 			return nil, err
 		}
-		resp, err = http.DefaultClient.Post(searchurl, "application/json", bytes.NewReader(body))
+		resp, err = Client.Post(searchurl, "application/json", bytes.NewReader(body))
 	}
-
 	if err != nil {
 		return nil, err
 	}
@@ -97,8 +228,8 @@ func (s *ESScoll) Start() (*Response, error) {
 		return nil, fmt.Errorf("non-200 status code on intial request %d from %v", resp.StatusCode, searchurl)
 	}
 
-	result := estypes.Results{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	result := &estypes.Results{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
 		return nil, err
 	}
 	if result.TimedOut {
@@ -107,90 +238,101 @@ func (s *ESScoll) Start() (*Response, error) {
 	if result.Hits == nil {
 		return nil, fmt.Errorf("invalid response")
 	}
+	return result, nil
+}
 
-	out := make(chan *estypes.Doc, s.buflen) // each result will actually get pagesz*shards documents
-	r := Response{Total: result.Hits.Total, Hits: out, mu: new(sync.Mutex)}
-
-	go func() {
-		defer close(out)
-		ctx, can := context.WithCancel(s.ctx)
-		prog := NewProgress(s.logevery, s.logger)
-		prog.Start(ctx)
-		prog.SetDocCount(r.Total)
-
-		docspages := make(chan []*estypes.Doc, 2)
-		wg := &sync.WaitGroup{}
-		wg.Add(1)
-		go func(wg *sync.WaitGroup, docspages chan []*estypes.Doc) {
-			defer wg.Done()
-			for hits := range docspages {
-				select {
-				case <-s.ctx.Done():
-					//TODO Save prgress
-					return
-				default:
-				}
-				for _, hit := range hits {
-					st := time.Now()
-					out <- hit
-					prog.MarkBlocked(time.Now().Sub(st))
-				}
-			}
-		}(wg, docspages)
-
-		baseurl := origurl.Scheme + "://" + origurl.Host + "/_search/scroll?scroll=" + s.timeout + "&scroll_id="
-
-		//TODO the array of docs all the way into esbulk
-		//TODO copy ScrollID with page
-		cnt := 0
-		for {
+// scroll sends the hits of a single scroll slice to out, starting with the
+// already fetched first page, until the scroll is exhausted and then clears
+// it. Every page fetched is sent in full before the slice's cursor is
+// advanced, and no page is fetched once ctx is done. A stopped scroll is kept
+// for its cursor.
+func (s *ESScoll) scroll(ctx context.Context, baseurl string, slice int, result *estypes.Results, out chan<- *estypes.Doc, prog *progress) error {
+	for len(result.Hits.Hits) > 0 {
+		prog.MarkProssed(len(result.Hits.Hits))
+		for _, hit := range result.Hits.Hits {
+			st := time.Now()
 			select {
-			case <-s.ctx.Done():
-				//TODO Save prgress
-				return
-			default:
-			}
-			// Get the next page
-			urli := baseurl + result.ScrollID
-			//s.logger.Infof("fetching from:%v", urli)
-			resp, err = Client.Get(urli)
-			if err != nil {
-				r.setErr(err)
-				return
-			}
-			if resp.StatusCode != 200 {
-				resp.Body.Close()
-				r.setErr(fmt.Errorf("non-200 status code on continuation %d", resp.StatusCode))
-				return
+			case out <- hit:
+			case <-ctx.Done():
+				// the rest of the page can't be read again
+				return nil
 			}
+			prog.MarkBlocked(time.Now().Sub(st))
+		}
+		s.advanceCursor(slice, result.ScrollID)
 
-			// Reset and decode results
-			result = estypes.Results{}
-			if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
-				resp.Body.Close()
-				r.setErr(err)
-				return
-			}
-			if result.TimedOut {
-				r.setErr(fmt.Errorf("timed-out on scroll"))
-				return
-			}
+		select {
+		case <-ctx.Done():
+			// the position is kept in ESScoll.Cursors
+			return nil
+		default:
+		}
 
-			if len(result.Hits.Hits) == 0 {
-				//defer s.logger.Infof("completed: %v ", cnt)
-				can()
-				close(docspages)
-				wg.Wait()
-				return
-			}
-			cnt++
-			hits := result.Hits.Hits
-			docspages <- hits
-			prog.MarkProssed(len(result.Hits.Hits))
+		// Get the next page
+		var err error
+		if result, err = s.next(baseurl, result.ScrollID); err != nil {
+			return err
 		}
-	}()
+	}
+	s.clear(baseurl, []*estypes.Results{result})
+	return nil
+}
 
-	return &r, nil
+// clear the scrolls of results so the server can free them. Failures are only
+// logged since the scrolls expire on their own.
+func (s *ESScoll) clear(baseurl string, results []*estypes.Results) {
+	ids := make([]string, 0, len(results))
+	for _, result := range results {
+		ids = append(ids, result.ScrollID)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string][]string{"scroll_id": ids})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("DELETE", baseurl, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := Client.Do(req)
+	if err != nil {
+		s.logger.Warnf("error clearing scrolls: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// next fetches the next page of the scroll identified by scrollID. The id is
+// sent in the body as it can be too long for a URL.
+func (s *ESScoll) next(baseurl, scrollID string) (*estypes.Results, error) {
+	body, err := json.Marshal(map[string]string{"scroll": s.timeout, "scroll_id": scrollID})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := Client.Post(baseurl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("non-200 status code on continuation %d", resp.StatusCode)
+	}
+
+	// Reset and decode results
+	result := &estypes.Results{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	if result.TimedOut {
+		return nil, fmt.Errorf("timed-out on scroll")
+	}
+	if result.Hits == nil {
+		return nil, fmt.Errorf("invalid response on continuation")
+	}
+	return result, nil
 }
 
 //TODO move this progress to it's own package and share it with esbulk so we collect retry and error, and other metrics.
@@ -290,9 +432,6 @@ func IECFormat(num_in uint64) string {
 	return fmt.Sprintf("%.1f%s%s", num, "Yi", suffix)
 }
 
-//TODO Implement continuing an already started scroll
-//func Continue(url, scrollID string) {}
-
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -0,0 +1,265 @@
+package esscroll
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lytics/escp/estypes"
+	log "github.com/lytics/escp/logging"
+	"github.com/lytics/escp/pipeline"
+)
+
+// SortByID is the default sort of a SearchAfter. The sort must be unique per
+// document for search_after to visit every document exactly once.
+var SortByID = SortBy("_id")
+
+// SortBy sorts a SearchAfter by field, which must be unique per document, such
+// as a keyword field holding each document's _id when sorting by _id fails
+// with ErrIDSortDisallowed.
+func SortBy(field string) []interface{} {
+	return []interface{}{map[string]string{field: "asc"}}
+}
+
+// ErrIDSortDisallowed is returned by SearchAfter.Start when the cluster
+// doesn't allow sorting by _id.
+var ErrIDSortDisallowed = errors.New("the cluster disallows sorting by _id (indices.id_field_data.enabled is false, the default since Elasticsearch 8); " +
+	"sort by a unique keyword field holding each document's _id instead, or enable the setting")
+
+// SearchAfter pages through an index with search_after instead of keeping a
+// scroll cursor alive. Every hit carries its sort values in Doc.Sort, which
+// can be passed back as after to resume reading following that document.
+//
+// SearchAfters created with NewPIT search through a point in time so the
+// pages are consistent with each other, like a scroll.
+type SearchAfter struct {
+	indexUrl  string
+	surl      string
+	keepalive string
+	pit       string
+	pagesz    int
+	buflen    int
+	filter    map[string]interface{}
+	after     json.RawMessage
+
+	// Sort of the search; defaults to SortByID.
+	Sort []interface{}
+
+	HitMeta
+
+	logevery time.Duration
+	logger   log.Logger
+	ctx      context.Context
+}
+
+var _ pipeline.Source = (*SearchAfter)(nil)
+
+// NewSearchAfter creates a search_after reader for the index at indexUrl,
+// which should be of the form http://host:port/indexname. If after is
+// non-empty reading starts following the document with those sort values.
+func NewSearchAfter(ctx context.Context, indexUrl string, pagesz, buflen int, filter map[string]interface{}, after json.RawMessage, logevery time.Duration, logger log.Logger) *SearchAfter {
+	return &SearchAfter{
+		indexUrl: indexUrl,
+		surl:     indexUrl + "/_search",
+		pagesz:   pagesz,
+		buflen:   buflen,
+		filter:   filter,
+		after:    after,
+		Sort:     SortByID,
+		logevery: logevery,
+		logger:   logger,
+		ctx:      ctx,
+	}
+}
+
+// NewPIT creates a search_after reader that opens a point in time on the
+// index at indexUrl and searches through it, keeping it alive for keepalive
+// between pages. Requires Elasticsearch 7.10 or newer.
+//
+// Since the sort values don't depend on the point in time, an interrupted
+// read can be resumed with after on a new point in time.
+func NewPIT(ctx context.Context, indexUrl string, keepalive time.Duration, pagesz, buflen int, filter map[string]interface{}, after json.RawMessage, logevery time.Duration, logger log.Logger) *SearchAfter {
+	s := NewSearchAfter(ctx, indexUrl, pagesz, buflen, filter, after, logevery, logger)
+	s.keepalive = fmt.Sprintf("%ds", int(keepalive.Seconds()))
+	return s
+}
+
+// Start reading pages. Response.Total is the number of documents matching the
+// search, including those before after.
+//
+// When Response.Hits is closed, Response.Err() should be checked to see if the
+// search completed successfully or not.
+func (s *SearchAfter) Start() (*pipeline.Response, error) {
+	if s.keepalive != "" {
+		if err := s.openPIT(); err != nil {
+			return nil, err
+		}
+	}
+	result, err := s.page(s.after, true)
+	if err != nil {
+		s.closePIT()
+		return nil, err
+	}
+
+	out := make(chan *estypes.Doc, s.buflen)
+	r := pipeline.NewResponse(uint64(result.Hits.Total), out)
+
+	go func() {
+		defer close(out)
+		defer s.closePIT()
+		ctx, can := context.WithCancel(s.ctx)
+		defer can()
+		prog := NewProgress(s.logevery, s.logger)
+		prog.Start(ctx)
+		prog.SetDocCount(r.Total)
+
+		for len(result.Hits.Hits) > 0 {
+			hits := result.Hits.Hits
+			prog.MarkProssed(len(hits))
+			for _, hit := range hits {
+				st := time.Now()
+				select {
+				case out <- hit:
+				case <-ctx.Done():
+					return
+				}
+				prog.MarkBlocked(time.Now().Sub(st))
+			}
+
+			last := hits[len(hits)-1]
+			if len(last.Sort) == 0 {
+				r.SetErr(fmt.Errorf("hit %s has no sort values", last.ID))
+				return
+			}
+			if result, err = s.page(last.Sort, false); err != nil {
+				r.SetErr(err)
+				return
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+// page fetches the page of results following the sort values in after. Hits
+// are only counted if first, as counting them for every page is expensive.
+func (s *SearchAfter) page(after json.RawMessage, first bool) (*estypes.Results, error) {
+	req := map[string]interface{}{
+		"size": s.pagesz,
+		"sort": s.Sort,
+	}
+	if len(after) > 0 {
+		req["search_after"] = after
+	}
+	s.HitMeta.apply(req)
+	if s.TrackTotalHits && !first {
+		req["track_total_hits"] = false
+	}
+	if s.filter != nil {
+		req["query"] = map[string]interface{}{
+			"bool": map[string]interface{}{"filter": s.filter},
+		}
+	}
+	surl := s.surl
+	if s.pit != "" {
+		// searches through a point in time must not name the index
+		req["pit"] = map[string]string{"id": s.pit, "keep_alive": s.keepalive}
+		surl = s.hostUrl() + "/_search?rest_total_hits_as_int=true"
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := Client.Post(surl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		if bytes.Contains(b, []byte("id_field_data")) {
+			return nil, ErrIDSortDisallowed
+		}
+		return nil, fmt.Errorf("non-200 status code on search_after request %d from %v: %s", resp.StatusCode, surl, b)
+	}
+
+	result := &estypes.Results{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	if result.TimedOut {
+		return nil, fmt.Errorf("search_after request timed out")
+	}
+	if result.Hits == nil {
+		return nil, fmt.Errorf("invalid response")
+	}
+	if result.PitID != "" {
+		// the point in time id may change between pages
+		s.pit = result.PitID
+	}
+	return result, nil
+}
+
+// openPIT opens the point in time to search through.
+func (s *SearchAfter) openPIT() error {
+	purl := fmt.Sprintf("%s/_pit?keep_alive=%s", s.indexUrl, s.keepalive)
+	resp, err := Client.Post(purl, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("non-200 status code opening point in time %d from %v", resp.StatusCode, purl)
+	}
+	pit := struct {
+		ID string `json:"id"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&pit); err != nil {
+		return err
+	}
+	if pit.ID == "" {
+		return fmt.Errorf("no point in time id returned from %v", purl)
+	}
+	s.pit = pit.ID
+	return nil
+}
+
+// closePIT releases the point in time, if any. Failures are only logged since
+// the point in time expires on its own.
+func (s *SearchAfter) closePIT() {
+	if s.pit == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]string{"id": s.pit})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("DELETE", s.hostUrl()+"/_pit", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := Client.Do(req)
+	if err != nil {
+		s.logger.Warnf("error closing point in time: %v", err)
+		return
+	}
+	resp.Body.Close()
+	s.pit = ""
+}
+
+// hostUrl returns the scheme and host of the index url.
+func (s *SearchAfter) hostUrl() string {
+	u, err := url.Parse(s.indexUrl)
+	if err != nil {
+		return s.indexUrl
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -1,33 +1,122 @@
 package estypes
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 )
 
 type Meta struct {
-	ID    string `json:"_id"`
-	Type  string `json:"_type"`
-	Index string `json:"_index"`
-	//Version string `json:"_version"` //FIXME _version not in _search results?!
+	ID      string `json:"_id"`
+	Type    string `json:"_type"`
+	Index   string `json:"_index"`
+	Routing string `json:"_routing,omitempty"`
+	Parent  string `json:"_parent,omitempty"`
+
+	// Only returned by searches that request them.
+	Version     int64  `json:"_version,omitempty"`
+	SeqNo       *int64 `json:"_seq_no,omitempty"`
+	PrimaryTerm int64  `json:"_primary_term,omitempty"`
+}
+
+// RoutingKey is the routing the document was indexed with. Children are routed
+// by their parent unless their routing is set.
+func (m *Meta) RoutingKey() string {
+	if m.Routing == "" {
+		return m.Parent
+	}
+	return m.Routing
 }
 
 type Doc struct {
 	Meta
 	Source json.RawMessage `json:"_source,omitempty"`
+	Sort   json.RawMessage `json:"sort,omitempty"` // sort values of sorted searches, usable as search_after
+
+	Delete bool `json:"-"` // delete the document instead of indexing it when writing
 }
 
 type Hits struct {
-	Hits  []*Doc `json:"hits"`
-	Total uint64 `json:"total"`
+	Hits  []*Doc    `json:"hits"`
+	Total TotalHits `json:"total"`
+}
+
+// TotalHits of a search. Elasticsearch 7+ returns an object with the value and
+// whether it is exact instead of a number; only the value is kept.
+type TotalHits uint64
+
+func (t *TotalHits) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(b, []byte("{")) {
+		v := struct {
+			Value uint64 `json:"value"`
+		}{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		*t = TotalHits(v.Value)
+		return nil
+	}
+	var n uint64
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*t = TotalHits(n)
+	return nil
 }
 
 type Results struct {
 	Hits     *Hits  `json:"hits"`
 	TimedOut bool   `json:"timed_out"`
 	ScrollID string `json:"_scroll_id"`
+	PitID    string `json:"pit_id,omitempty"`
 }
 
+// Info returned by the root endpoint of a cluster.
+type Info struct {
+	Name        string `json:"name"`
+	ClusterName string `json:"cluster_name"`
+	Version     struct {
+		Number string `json:"number"`
+	} `json:"version"`
+}
+
+// Version of Elasticsearch.
+type Version struct {
+	Major int
+	Minor int
+}
+
+// ParseVersion parses version numbers like 6.8.23 or 8.0.0-SNAPSHOT.
+func ParseVersion(number string) (Version, error) {
+	parts := strings.SplitN(number, ".", 3)
+	if len(parts) < 2 {
+		return Version{}, fmt.Errorf("invalid version %q", number)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version %q: %v", number, err)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version %q: %v", number, err)
+	}
+	return Version{Major: major, Minor: minor}, nil
+}
+
+// AtLeast returns true if v is major.minor or newer.
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// Typeless returns true if the cluster no longer uses mapping types; from 7.0
+// documents are addressed as _doc.
+func (v Version) Typeless() bool { return v.AtLeast(7, 0) }
+
+func (v Version) String() string { return fmt.Sprintf("%d.%d", v.Major, v.Minor) }
+
 type AckResponse struct {
 	Ack bool `json:"acknowledged"`
 }
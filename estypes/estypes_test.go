@@ -0,0 +1,85 @@
+package estypes
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTotalHits(t *testing.T) {
+	tests := []struct {
+		json string
+		want TotalHits
+		err  bool
+	}{
+		{json: `0`, want: 0},
+		{json: `12345`, want: 12345},
+		{json: `{"value":10000,"relation":"gte"}`, want: 10000},
+		{json: `{"value":7,"relation":"eq"}`, want: 7},
+		{json: `{"relation":"eq"}`, want: 0},
+		{json: `"7"`, err: true},
+		{json: `-1`, err: true},
+		{json: `{"value":"7"}`, err: true},
+	}
+	for _, tc := range tests {
+		var h Hits
+		err := json.Unmarshal([]byte(`{"total":`+tc.json+`}`), &h)
+		switch {
+		case tc.err && err == nil:
+			t.Errorf("%s: expected an error", tc.json)
+		case !tc.err && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.json, err)
+		case !tc.err && h.Total != tc.want:
+			t.Errorf("%s: %d; expected %d", tc.json, h.Total, tc.want)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		number   string
+		want     Version
+		err      bool
+		typeless bool
+	}{
+		{number: "6.8.23", want: Version{Major: 6, Minor: 8}},
+		{number: "7.0.0", want: Version{Major: 7}, typeless: true},
+		{number: "7.17.9", want: Version{Major: 7, Minor: 17}, typeless: true},
+		{number: "8.0.0-SNAPSHOT", want: Version{Major: 8}, typeless: true},
+		{number: "8.11", want: Version{Major: 8, Minor: 11}, typeless: true},
+		{number: "5.6.16", want: Version{Major: 5, Minor: 6}},
+		{number: "8", err: true},
+		{number: "", err: true},
+		{number: "x.1.0", err: true},
+		{number: "7.x", err: true},
+	}
+	for _, tc := range tests {
+		v, err := ParseVersion(tc.number)
+		switch {
+		case tc.err && err == nil:
+			t.Errorf("%q: expected an error", tc.number)
+		case !tc.err && err != nil:
+			t.Errorf("%q: unexpected error: %v", tc.number, err)
+		case !tc.err && (v != tc.want || v.Typeless() != tc.typeless):
+			t.Errorf("%q: %v typeless:%t; expected %v typeless:%t", tc.number, v, v.Typeless(), tc.want, tc.typeless)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		v            Version
+		major, minor int
+		want         bool
+	}{
+		{v: Version{7, 10}, major: 7, minor: 10, want: true},
+		{v: Version{7, 9}, major: 7, minor: 10},
+		{v: Version{7, 17}, major: 7, minor: 10, want: true},
+		{v: Version{8, 0}, major: 7, minor: 10, want: true},
+		{v: Version{6, 8}, major: 7, minor: 0},
+	}
+	for _, tc := range tests {
+		if got := tc.v.AtLeast(tc.major, tc.minor); got != tc.want {
+			t.Errorf("%v at least %d.%d: %t; expected %t", tc.v, tc.major, tc.minor, got, tc.want)
+		}
+	}
+}
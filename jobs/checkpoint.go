@@ -0,0 +1,186 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lytics/escp/estypes"
+	log "github.com/lytics/escp/logging"
+)
+
+// Checkpoint records how far a copy got. After is the sort key of the last
+// document that, along with every document read before it, has been
+// acknowledged by the destination.
+type Checkpoint struct {
+	Source      string          `json:"source"`
+	Destination string          `json:"destination"`
+	After       json.RawMessage `json:"search_after,omitempty"`
+	Docs        uint64          `json:"docs"` // documents acknowledged so far
+	Done        bool            `json:"done"` // the copy completed
+	Updated     time.Time       `json:"updated"`
+}
+
+// LoadCheckpoint reads a checkpoint file written by a previous copy.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint %s: %v", path, err)
+	}
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, fmt.Errorf("error decoding checkpoint %s: %v", path, err)
+	}
+	return cp, nil
+}
+
+// Save the checkpoint to path. The file is replaced atomically so a crash
+// while saving leaves the previous checkpoint intact.
+func (c *Checkpoint) Save(path string) error {
+	c.Updated = time.Now()
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding checkpoint: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("error writing checkpoint %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkpointer advances a Checkpoint as documents are acknowledged. Parallel
+// bulk uploads acknowledge documents out of order, so the checkpoint only moves
+// past a document once every document read before it is acknowledged too.
+type checkpointer struct {
+	path   string
+	every  time.Duration
+	logger log.Logger
+
+	mu    sync.Mutex
+	cp    *Checkpoint
+	next  uint64                     // sequence of the next document read
+	done  uint64                     // every sequence below done is acknowledged
+	seqs  map[*estypes.Doc]uint64    // sequences of unacknowledged documents
+	acked map[uint64]json.RawMessage // acknowledged sequences >= done and < stuck
+	stuck uint64                     // first sequence that was lost and can never be acknowledged
+	lost  int                        // documents lost
+	saved time.Time
+}
+
+func newCheckpointer(path string, cp *Checkpoint, every time.Duration, logger log.Logger) *checkpointer {
+	return &checkpointer{
+		path:   path,
+		every:  every,
+		logger: logger,
+		cp:     cp,
+		seqs:   make(map[*estypes.Doc]uint64),
+		acked:  make(map[uint64]json.RawMessage),
+		stuck:  math.MaxUint64,
+		saved:  time.Now(),
+	}
+}
+
+// track assigns every document from in a sequence number in the order it was
+// read before passing it on.
+func (c *checkpointer) track(in <-chan *estypes.Doc) <-chan *estypes.Doc {
+	out := make(chan *estypes.Doc, cap(in))
+	go func() {
+		defer close(out)
+		for doc := range in {
+			c.mu.Lock()
+			c.seqs[doc] = c.next
+			c.next++
+			c.mu.Unlock()
+			out <- doc
+		}
+	}()
+	return out
+}
+
+// ack marks docs as written and advances the checkpoint as far as possible.
+// Suitable for use as esbulk.Config.OnAck.
+func (c *checkpointer) ack(docs []*estypes.Doc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, doc := range docs {
+		seq, ok := c.seqs[doc]
+		if !ok {
+			continue
+		}
+		delete(c.seqs, doc)
+		if seq < c.stuck {
+			c.acked[seq] = doc.Sort
+		}
+	}
+	for {
+		after, ok := c.acked[c.done]
+		if !ok {
+			break
+		}
+		delete(c.acked, c.done)
+		c.cp.After = after
+		c.cp.Docs++
+		c.done++
+	}
+	if time.Since(c.saved) >= c.every {
+		c.save()
+	}
+}
+
+// lose marks docs as dropped without being written. The checkpoint can never
+// move past them, so acknowledgements after the first lost document are no
+// longer kept. Suitable for use as esbulk.Config.OnLost.
+func (c *checkpointer) lose(docs []*estypes.Doc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, doc := range docs {
+		seq, ok := c.seqs[doc]
+		if !ok {
+			continue
+		}
+		delete(c.seqs, doc)
+		c.lost++
+		if seq >= c.stuck {
+			continue
+		}
+		if c.stuck == math.MaxUint64 {
+			c.logger.Errorf("documents were dropped without a dead-letter file; the checkpoint can't advance past %d documents", c.cp.Docs+seq-c.done)
+		}
+		c.stuck = seq
+		for s := range c.acked {
+			if s >= seq {
+				delete(c.acked, s)
+			}
+		}
+	}
+}
+
+// dropped returns the number of documents lost.
+func (c *checkpointer) dropped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lost
+}
+
+// finish saves the checkpoint a final time, marking it done if the copy
+// completed.
+func (c *checkpointer) finish(done bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cp.Done = done && len(c.seqs) == 0 && len(c.acked) == 0 && c.lost == 0
+	return c.cp.Save(c.path)
+}
+
+// save must be called with mu held.
+func (c *checkpointer) save() {
+	if err := c.cp.Save(c.path); err != nil {
+		c.logger.Errorf("error saving checkpoint: %v", err)
+		return
+	}
+	c.saved = time.Now()
+}
@@ -0,0 +1,106 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lytics/escp/estypes"
+	log "github.com/lytics/escp/logging"
+)
+
+// step acknowledges, or loses, the documents read in the given order.
+type step struct {
+	lose bool
+	seqs []int
+}
+
+func ackSeqs(seqs ...int) step  { return step{seqs: seqs} }
+func loseSeqs(seqs ...int) step { return step{lose: true, seqs: seqs} }
+
+func TestCheckpointer(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int // documents read
+		steps   []step
+		docs    uint64 // documents the checkpoint is past
+		after   string // sort key of the last of them
+		dropped int
+		done    bool // checkpoint is done when finished
+	}{
+		{name: "nothing read", done: true},
+		{name: "in order", n: 3, steps: []step{ackSeqs(0), ackSeqs(1, 2)}, docs: 3, after: "[2]", done: true},
+		{name: "out of order", n: 5, steps: []step{ackSeqs(1, 2), ackSeqs(0, 4), ackSeqs(3)}, docs: 5, after: "[4]", done: true},
+		{name: "gap", n: 5, steps: []step{ackSeqs(1, 2), ackSeqs(0, 4)}, docs: 3, after: "[2]"},
+		{name: "none acknowledged", n: 2, steps: []step{ackSeqs(1)}},
+		{name: "acknowledged twice", n: 2, steps: []step{ackSeqs(0), ackSeqs(0, 1)}, docs: 2, after: "[1]", done: true},
+		{
+			name:  "lost",
+			n:     6,
+			steps: []step{ackSeqs(1, 4), loseSeqs(2, 3), ackSeqs(5, 0)},
+			docs:  2, after: "[1]", dropped: 2,
+		},
+		{
+			name:  "lost before earlier documents",
+			n:     4,
+			steps: []step{loseSeqs(3), loseSeqs(1), ackSeqs(0, 2)},
+			docs:  1, after: "[0]", dropped: 2,
+		},
+		{name: "lost first", n: 3, steps: []step{loseSeqs(0), ackSeqs(1, 2)}, dropped: 1},
+	}
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.NewStdLogger(false, log.DEBUG, "")
+	for i, tc := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		c := newCheckpointer(path, &Checkpoint{}, time.Hour, logger)
+		in := make(chan *estypes.Doc, tc.n)
+		read := make([]*estypes.Doc, tc.n)
+		for i := range read {
+			read[i] = &estypes.Doc{Sort: json.RawMessage(fmt.Sprintf("[%d]", i))}
+			in <- read[i]
+		}
+		close(in)
+		for range c.track(in) {
+		}
+		for _, s := range tc.steps {
+			ds := make([]*estypes.Doc, len(s.seqs))
+			for i, seq := range s.seqs {
+				ds[i] = read[seq]
+			}
+			if s.lose {
+				c.lose(ds)
+			} else {
+				c.ack(ds)
+			}
+		}
+		if err := c.finish(true); err != nil {
+			t.Errorf("%s: error finishing: %v", tc.name, err)
+			continue
+		}
+		cp, err := LoadCheckpoint(path)
+		if err != nil {
+			t.Errorf("%s: error loading: %v", tc.name, err)
+			continue
+		}
+		after := &bytes.Buffer{}
+		if len(cp.After) > 0 {
+			json.Compact(after, cp.After)
+		}
+		if cp.Docs != tc.docs || after.String() != tc.after || cp.Done != tc.done {
+			t.Errorf("%s: checkpoint past %d docs after %s done:%t; expected %d after %s done:%t",
+				tc.name, cp.Docs, after, cp.Done, tc.docs, tc.after, tc.done)
+		}
+		if n := c.dropped(); n != tc.dropped {
+			t.Errorf("%s: dropped %d; expected %d", tc.name, n, tc.dropped)
+		}
+	}
+}
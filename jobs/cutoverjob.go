@@ -0,0 +1,48 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lytics/escp/esindex"
+	log "github.com/lytics/escp/logging"
+)
+
+// Cutover copies src to des, validates the copied documents with opts and,
+// only if they all match, atomically moves alias on the destination cluster
+// from the indices it points to onto the destination index. If the copy or
+// validation fails the alias is left where it is.
+func Cutover(ctx context.Context, src *SourceConfig, des *DesConfig, alias string, opts *ValidateOptions, logger log.Logger, logevery time.Duration) (*ValidationResults, error) {
+	// validate every document, not just those copied after a checkpoint
+	vsrc := *src
+	vsrc.After = nil
+	vsrc.Cursors = nil
+
+	if err := Copy(ctx, src, des, logger, logevery); err != nil {
+		return nil, fmt.Errorf("copy failed; alias %s not moved: %v", alias, err)
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("copy canceled; alias %s not moved", alias)
+	}
+
+	priDesUrl := des.PrimaryURL()
+	if err := esindex.Refresh(priDesUrl); err != nil {
+		return nil, fmt.Errorf("error refreshing %s; alias %s not moved: %v", priDesUrl, alias, err)
+	}
+
+	logger.Infof("Copy completed. Validating before moving alias %s", alias)
+	vr, err := Validate(ctx, &vsrc, des, opts, logger, logevery)
+	if err != nil {
+		return vr, fmt.Errorf("validation failed; alias %s not moved: %v", alias, err)
+	}
+	logger.Infof("validation results: %v", vr)
+
+	host := des.URLs()[0]
+	from, err := esindex.SwapAlias(host, alias, des.IndexName)
+	if err != nil {
+		return vr, fmt.Errorf("error moving alias %s to %s: %v", alias, des.IndexName, err)
+	}
+	logger.Infof("alias %s moved from %v to %s", alias, from, des.IndexName)
+	return vr, nil
+}
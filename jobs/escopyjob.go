@@ -3,7 +3,10 @@ package jobs
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -13,6 +16,7 @@ import (
 	"github.com/lytics/escp/esindex"
 	"github.com/lytics/escp/esscroll"
 	log "github.com/lytics/escp/logging"
+	"github.com/lytics/escp/pipeline"
 )
 
 func ParseUrl(u string) (*url.URL, error) {
@@ -34,7 +38,16 @@ type SourceConfig struct {
 	ScrollTimeout time.Duration          // time to keep scroll alive between requests
 	ScrollPage    int                    // size of scroll pages (will actually be per source shard)
 	ScrollDocs    int                    // number of `docs` to buffer in memory from scroll
+	Slices        int                    // number of sliced scrolls to read concurrently; < 2 uses a single scroll
 	Filter        map[string]interface{} // an es filter to apply to the source scroll (experimental)
+	Cursors       []esscroll.Cursor      // continue an already started scroll from these cursors instead of starting a new one
+	CursorFile    string                 // file to save the scroll cursors to when a scrolled copy stops early, so it can be continued with Cursors
+	Sorted        bool                   // read with search_after sorted by _id, or SortField, instead of a scroll; required for checkpoints
+	After         json.RawMessage        // if Sorted, start reading after the document with this sort key
+	PIT           bool                   // if Sorted, search through a point in time kept alive for ScrollTimeout; requires ES 7.10+
+	SortField     string                 // if Sorted, a keyword field holding each document's _id to sort by where sorting by _id is disallowed
+
+	esscroll.HitMeta // metadata to read along with each document; see DetectVersion
 }
 
 func (s *SourceConfig) URL() string {
@@ -44,11 +57,56 @@ func (s *SourceConfig) URL() string {
 	return fmt.Sprintf("%s/%s", s.Host.String(), s.IndexName)
 }
 
+// DetectVersion of the source cluster and set TrackTotalHits to match.
+func (s *SourceConfig) DetectVersion(logger log.Logger) error {
+	s.URL() // defaults the scheme
+	v, err := esindex.GetVersion(s.Host.String())
+	if err != nil {
+		return fmt.Errorf("failed getting source version: %v", err)
+	}
+	logger.Infof("source %s is Elasticsearch %v", s.Host, v)
+	s.TrackTotalHits = v.AtLeast(7, 0)
+	return nil
+}
+
+// Source reads the source index with a scroll, a continued scroll or
+// search_after depending on the config.
+func (s *SourceConfig) Source(ctx context.Context, logger log.Logger, logevery time.Duration) pipeline.Source {
+	srcUrl := s.URL()
+	switch {
+	case s.Sorted:
+		if len(s.After) > 0 {
+			logger.Infof("Resuming sorted read after %s", string(s.After))
+		}
+		var sa *esscroll.SearchAfter
+		if s.PIT {
+			sa = esscroll.NewPIT(ctx, srcUrl, s.ScrollTimeout, s.ScrollPage, s.ScrollDocs, s.Filter, s.After, logevery, logger)
+		} else {
+			sa = esscroll.NewSearchAfter(ctx, srcUrl, s.ScrollPage, s.ScrollDocs, s.Filter, s.After, logevery, logger)
+		}
+		sa.HitMeta = s.HitMeta
+		if s.SortField != "" {
+			sa.Sort = esscroll.SortBy(s.SortField)
+		}
+		return sa
+	case len(s.Cursors) > 0:
+		logger.Infof("Continuing scroll from %d cursors", len(s.Cursors))
+		return esscroll.Continue(ctx, srcUrl, s.ScrollTimeout, s.ScrollDocs, s.Cursors, logevery, logger)
+	default:
+		ess := esscroll.New(ctx, srcUrl, s.ScrollTimeout, s.ScrollPage, s.ScrollDocs, s.Filter, logevery, logger)
+		ess.Slices = s.Slices
+		ess.HitMeta = s.HitMeta
+		return ess
+	}
+}
+
 type DesConfig struct {
 	IndexName string     //The target index name
 	Hosts     []*url.URL //set of hosts to use during the copy, to send Bulk requests too.
 
-	CreateDelay       time.Duration // after creating a new target index, sleep this long before writing data.
+	CreateDelay       time.Duration // if > 0, sleep this long after creating a new target index instead of waiting for HealthStatus
+	HealthStatus      string        // index health to wait for after creating the index and before completing; "" = green
+	HealthTimeout     time.Duration // how long to wait for HealthStatus each time; 0 = 30m
 	RefreshInt        time.Duration // the refresh interval to use on the new index
 	Shards            int           // how many shards to use with the next index
 	DelayRefresh      bool          // Disable refreshing until the copy has completed
@@ -56,9 +114,25 @@ type DesConfig struct {
 	DelayReplicaton   bool          //turn off ES replication until after the copy has finished.
 	ReplicationFactor int           //if delayreplication is set the replicaiton setting will be set to this after coping.
 	MaxSeg            int           //if indexing is delayed, the max number of segments for the optimized index
+	Mapping           string        // file with mappings, analysis settings or aliases to create the index with instead of the source's
+	CopyAliases       bool          // create the index with the source index's aliases
 
 	BulkSize   int // The pulk batch size to use when submitting writes to des index bulk queue.
 	NumWorkers int //number of parallel bulk upload buffers to use; 0 = len(hosts)*2
+
+	AdaptiveBulk bool // adapt the bulk size and number of workers to cluster pushback, starting from BulkSize and NumWorkers
+	MaxBulkSize  int  // if AdaptiveBulk, the largest bulk size to use; 0 = 4*BulkSize
+	MaxWorkers   int  // if AdaptiveBulk, the most parallel bulk uploads to use; 0 = 4*NumWorkers
+
+	Checkpoint      string        // file to record acknowledged progress in so the copy can be resumed; requires a Sorted source
+	CheckpointEvery time.Duration // how often to save the checkpoint; 0 = every 10s
+	Resume          bool          // continue the copy recorded in Checkpoint into the existing index
+
+	DeadLetter string              // file to write documents that permanently fail indexing to; "" drops them
+	Retry      *esbulk.RetryPolicy // how bulk indexing failures are classified and retried; nil = esbulk.DefaultRetryPolicy()
+
+	VersionType string // if set, e.g. "external", index documents with their source version; requires a source reading versions
+	Typeless    bool   // the destination is ES 7+ and documents are written without types; see DetectVersion
 }
 
 func (d *DesConfig) URLs() []string {
@@ -72,6 +146,60 @@ func (d *DesConfig) URLs() []string {
 	return res
 }
 
+// DetectVersion of the destination cluster and set Typeless to match.
+func (d *DesConfig) DetectVersion(logger log.Logger) error {
+	urls := d.URLs()
+	if len(urls) == 0 {
+		return fmt.Errorf("no destination hosts")
+	}
+	v, err := esindex.GetVersion(urls[0])
+	if err != nil {
+		return fmt.Errorf("failed getting destination version: %v", err)
+	}
+	logger.Infof("destination %s is Elasticsearch %v", urls[0], v)
+	d.Typeless = v.Typeless()
+	return nil
+}
+
+// BulkConfig for writing to the destination index with esbulk.
+func (d *DesConfig) BulkConfig() *esbulk.Config {
+	cfg := &esbulk.Config{
+		Hosts:   d.URLs(),
+		Index:   d.IndexName,
+		BufSize: d.BulkSize,
+		Par:     d.NumWorkers,
+		Retry:   d.Retry,
+
+		VersionType: d.VersionType,
+		Typeless:    d.Typeless,
+
+		Adaptive:   d.AdaptiveBulk,
+		MaxBufSize: d.MaxBulkSize,
+		MaxPar:     d.MaxWorkers,
+	}
+	if d.DeadLetter != "" {
+		cfg.DeadLetter = esbulk.NewDeadLetterFile(d.DeadLetter, d.IndexName)
+	}
+	return cfg
+}
+
+// waitForHealth waits for the destination index to reach HealthStatus.
+func (d *DesConfig) waitForHealth(logger log.Logger) error {
+	status, timeout := d.HealthStatus, d.HealthTimeout
+	if status == "" {
+		status = "green"
+	}
+	if timeout == 0 {
+		timeout = 30 * time.Minute
+	}
+	st := time.Now()
+	if err := esindex.WaitForHealth(d.PrimaryURL(), status, timeout); err != nil {
+		return fmt.Errorf("error waiting for index health: %v", err)
+	}
+	logger.Infof("index %s is %s after %v", d.IndexName, status, time.Since(st))
+	return nil
+}
+
 func (d *DesConfig) PrimaryURL() string {
 	// Use the first destination host as the "primary" node to talk too
 	if urls := d.URLs(); len(urls) > 0 {
@@ -80,10 +208,47 @@ func (d *DesConfig) PrimaryURL() string {
 	return ""
 }
 
+// ErrDeadLettered is returned when the copy finished but some documents were
+// written to the dead-letter file instead of the destination index.
+var ErrDeadLettered = errors.New("documents were dead-lettered")
+
 func Copy(ctx context.Context, src *SourceConfig, des *DesConfig, logger log.Logger, logevery time.Duration) error {
+	// stops the source, and any goroutines reading it, when the copy fails
+	ctx, can := context.WithCancel(ctx)
+	defer can()
+
 	srcUrl := src.URL()
 	priDesUrl := des.PrimaryURL()
 
+	if des.Checkpoint != "" && !src.Sorted {
+		return fmt.Errorf("checkpointing requires a sorted source")
+	}
+	checkpoint := &Checkpoint{Source: srcUrl, Destination: priDesUrl, After: src.After}
+	if des.Resume {
+		cp, err := LoadCheckpoint(des.Checkpoint)
+		if err != nil {
+			return err
+		}
+		if cp.Source != srcUrl || cp.Destination != priDesUrl {
+			return fmt.Errorf("checkpoint is for copying %s to %s", cp.Source, cp.Destination)
+		}
+		if cp.Done {
+			logger.Infof("checkpoint %s is already done; nothing to resume", des.Checkpoint)
+			return nil
+		}
+		logger.Infof("Resuming copy after %d acknowledged documents", cp.Docs)
+		checkpoint = cp
+		src.After = cp.After
+		des.SkipCreate = true
+	}
+
+	if err := src.DetectVersion(logger); err != nil {
+		return err
+	}
+	if err := des.DetectVersion(logger); err != nil {
+		return err
+	}
+
 	idxmeta, err := esindex.Get(srcUrl)
 	if err != nil {
 		return fmt.Errorf("failed getting source index metadata: %v", err)
@@ -108,8 +273,8 @@ func Copy(ctx context.Context, src *SourceConfig, des *DesConfig, logger log.Log
 	}
 
 	// Start the scroll first to make sure the source parameter is valid
-	ess := esscroll.New(ctx, srcUrl, src.ScrollTimeout, src.ScrollPage, src.ScrollDocs, src.Filter, logevery, logger)
-	resp, err := ess.Start()
+	source := src.Source(ctx, logger, logevery)
+	resp, err := source.Start()
 	if err != nil {
 		return fmt.Errorf("error starting scroll: %v", err)
 	}
@@ -143,12 +308,19 @@ func Copy(ctx context.Context, src *SourceConfig, des *DesConfig, logger log.Log
 			i := 0
 			m.Settings.Index.Replicas = &i
 		}
+		if err := copyMappings(&m, idxmeta, des); err != nil {
+			return err
+		}
 		if err := esindex.Create(priDesUrl, &m); err != nil {
 			logger.Errorf("index create failed:%v", err)
 			return err
 		}
 
-		time.Sleep(des.CreateDelay)
+		if des.CreateDelay > 0 {
+			time.Sleep(des.CreateDelay)
+		} else if err := des.waitForHealth(logger); err != nil {
+			return err
+		}
 	}
 
 	desmeta, err := esindex.Get(priDesUrl)
@@ -156,7 +328,7 @@ func Copy(ctx context.Context, src *SourceConfig, des *DesConfig, logger log.Log
 		logger.Errorf("error loading destination index settings. err:%v", err)
 		return err
 	}
-	b, err := json.Marshal(desmeta)
+	b, err := json.Marshal(desmeta.Settings)
 	if err != nil {
 		logger.Errorf("error marshalling index settings. err:%v", err)
 		return err
@@ -165,19 +337,63 @@ func Copy(ctx context.Context, src *SourceConfig, des *DesConfig, logger log.Log
 	logger.Infof("Copying %d documents from %s to %s/%s destination index settings: %v bulksize:%v",
 		resp.Total, srcUrl, des.Hosts, des.IndexName, string(b), esscroll.IECFormat(uint64(des.BulkSize)))
 
-	indexer := esbulk.New(ctx, des.URLs(), des.IndexName, des.BulkSize, des.NumWorkers, resp.Hits, logger)
-	if err := <-indexer.Err(); err != nil {
-		return fmt.Errorf("Error indexing: %v", err)
+	bcfg := des.BulkConfig()
+	bcfg.LogEvery = logevery
+	hits := resp.Hits
+	var cp *checkpointer
+	if des.Checkpoint != "" {
+		every := des.CheckpointEvery
+		if every == 0 {
+			every = 10 * time.Second
+		}
+		cp = newCheckpointer(des.Checkpoint, checkpoint, every, logger)
+		hits = cp.track(hits)
+		bcfg.OnAck = cp.ack
+		bcfg.OnLost = cp.lose
+	}
+
+	// The sink isn't stopped with ctx: once the source stops it closes hits,
+	// and the hits it already read are still indexed before the cursors are
+	// saved.
+	sinkctx, sinkcan := context.WithCancel(context.Background())
+	defer sinkcan()
+	sink := esbulk.NewSink(bcfg, logger)
+	idxerr := <-sink.Write(sinkctx, hits)
+	if bcfg.DeadLetter != nil {
+		if err := bcfg.DeadLetter.Close(); err != nil {
+			logger.Errorf("error closing dead-letter file: %v", err)
+		}
+	}
+	if cp != nil {
+		completed := idxerr == nil && resp.Err() == nil && ctx.Err() == nil
+		if err := cp.finish(completed); err != nil {
+			logger.Errorf("error saving checkpoint: %v", err)
+		}
+		logger.Infof("checkpoint saved to %s", des.Checkpoint)
+	}
+	if idxerr != nil {
+		can() // stop reading documents that can't be indexed
+	}
+	if idxerr != nil || resp.Err() != nil || ctx.Err() != nil {
+		saveCursors(src.CursorFile, source, logger)
+	} else if src.CursorFile != "" {
+		// a completed copy can't be continued
+		os.Remove(src.CursorFile)
+	}
+	if idxerr != nil {
+		return fmt.Errorf("Error indexing: %v", idxerr)
+	}
+	if cp != nil && cp.dropped() > 0 {
+		return fmt.Errorf("Error indexing: %d documents were dropped without a dead-letter file, so the checkpoint can't advance past them", cp.dropped())
 	}
 
 	if err := resp.Err(); err != nil {
-		logger.Errorf("Error searching: %v", err)
+		// the documents after the error weren't copied
+		return fmt.Errorf("Error searching: %v", err)
 	}
 
-	select {
-	case <-ctx.Done():
-		return nil
-	default:
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("copy stopped before completing: %v", err)
 	}
 
 	if des.DelayRefresh {
@@ -203,14 +419,116 @@ func Copy(ctx context.Context, src *SourceConfig, des *DesConfig, logger log.Log
 		logger.Infof("index updated to enable replication factor:%v", des.ReplicationFactor)
 	}
 
+	if err := des.waitForHealth(logger); err != nil {
+		return err
+	}
+
 	desmeta, err = esindex.Get(priDesUrl)
 	if err != nil {
 		return fmt.Errorf("error loading destination index settings. err:%v", err)
 	}
-	b, err = json.Marshal(desmeta)
+	b, err = json.Marshal(desmeta.Settings)
 	if err != nil {
 		return fmt.Errorf("error marshalling index settings. err:%v", err)
 	}
 	logger.Infof("copy job completed: destination index settngs: idx:%v settings:%v", priDesUrl, string(b))
+	return deadLettered(bcfg, logger)
+}
+
+// copyMappings sets the mappings, analysis settings and, if des.CopyAliases,
+// the aliases of the source index on the destination index's metadata m,
+// unless they're overridden by des.Mapping. Mapping types are added or
+// removed to suit the destination.
+func copyMappings(m *esindex.Meta, src *esindex.Meta, des *DesConfig) error {
+	m.Mappings = src.Mappings
+	m.Settings.Index.Analysis = src.Settings.Index.Analysis
+	if des.CopyAliases {
+		m.Aliases = src.Aliases
+	}
+
+	if des.Mapping != "" {
+		b, err := ioutil.ReadFile(des.Mapping)
+		if err != nil {
+			return fmt.Errorf("error reading mapping file: %v", err)
+		}
+		// analysis may be given with or without the index level
+		override := struct {
+			Mappings json.RawMessage `json:"mappings"`
+			Aliases  json.RawMessage `json:"aliases"`
+			Settings struct {
+				Analysis json.RawMessage `json:"analysis"`
+				Index    struct {
+					Analysis json.RawMessage `json:"analysis"`
+				} `json:"index"`
+			} `json:"settings"`
+		}{}
+		if err := json.Unmarshal(b, &override); err != nil {
+			return fmt.Errorf("error decoding mapping file %s: %v", des.Mapping, err)
+		}
+		if len(override.Mappings) > 0 {
+			m.Mappings = override.Mappings
+		}
+		if len(override.Aliases) > 0 {
+			m.Aliases = override.Aliases
+		}
+		if len(override.Settings.Analysis) > 0 {
+			m.Settings.Index.Analysis = override.Settings.Analysis
+		}
+		if len(override.Settings.Index.Analysis) > 0 {
+			m.Settings.Index.Analysis = override.Settings.Index.Analysis
+		}
+	}
+
+	var err error
+	if des.Typeless {
+		m.Mappings, err = esindex.Typeless(m.Mappings)
+	} else {
+		m.Mappings, err = esindex.Typed(m.Mappings)
+	}
+	if err != nil {
+		return fmt.Errorf("error converting mappings for destination: %v", err)
+	}
+	return nil
+}
+
+// deadLettered returns ErrDeadLettered if any documents were written to the
+// dead-letter file of cfg.
+func deadLettered(cfg *esbulk.Config, logger log.Logger) error {
+	if cfg.DeadLetter == nil {
+		return nil
+	}
+	if n := cfg.DeadLetter.Count(); n > 0 {
+		logger.Errorf("%d documents could not be indexed and were written to %s", n, cfg.DeadLetter.Path())
+		return ErrDeadLettered
+	}
 	return nil
 }
+
+// saveCursors saves the scroll position to path so a stopped copy can be
+// continued with SourceConfig.Cursors while the scroll is still alive. Without
+// a path the cursors are only logged.
+func saveCursors(path string, source pipeline.Source, logger log.Logger) {
+	ess, ok := source.(*esscroll.ESScoll)
+	if !ok {
+		return
+	}
+	b, err := json.Marshal(ess.Cursors())
+	if err != nil {
+		logger.Errorf("error marshalling scroll cursors. err:%v", err)
+		return
+	}
+	if path == "" {
+		logger.Infof("scroll stopped at cursors: %s", string(b))
+		return
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		logger.Errorf("error saving scroll cursors to %s: %v; cursors: %s", path, err, string(b))
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logger.Errorf("error saving scroll cursors to %s: %v; cursors: %s", path, err, string(b))
+		return
+	}
+	logger.Infof("scroll cursors saved to %s", path)
+}
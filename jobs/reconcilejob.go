@@ -0,0 +1,194 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lytics/escp/esbulk"
+	"github.com/lytics/escp/esdiff"
+	"github.com/lytics/escp/estypes"
+	log "github.com/lytics/escp/logging"
+	"github.com/lytics/escp/pipeline"
+)
+
+// ReconcileResults of a Reconcile.
+type ReconcileResults struct {
+	Source      int      // documents in the source
+	Destination int      // documents in the destination
+	Extra       int      // documents only in the destination
+	Deleted     int      // extra documents deleted from the destination, less those dead-lettered
+	IDs         []string // ids of the extra documents if it was a dry run
+}
+
+func (r *ReconcileResults) String() string {
+	return fmt.Sprintf("source=%d destination=%d extra=%d deleted=%d", r.Source, r.Destination, r.Extra, r.Deleted)
+}
+
+// Reconcile deletes the documents of the destination index that aren't in the
+// source, which copies can't see. Both indexes are read sorted by _id and
+// merged. If dryRun nothing is deleted and the extra ids are returned instead.
+//
+// Documents created in the source while reconciling may be deleted from the
+// destination if they were copied in the meantime, so nothing should be
+// copying into the destination while reconciling.
+func Reconcile(ctx context.Context, src *SourceConfig, des *DesConfig, dryRun bool, logger log.Logger, logevery time.Duration) (*ReconcileResults, error) {
+	res := &ReconcileResults{}
+	if err := src.DetectVersion(logger); err != nil {
+		return res, err
+	}
+	if err := des.DetectVersion(logger); err != nil {
+		return res, err
+	}
+
+	ctx, can := context.WithCancel(ctx)
+	defer can()
+	deletes := make(chan *estypes.Doc, 1000)
+	var idxerr <-chan error
+	bcfg := des.BulkConfig()
+	bcfg.LogEvery = logevery
+	if !dryRun {
+		idxerr = esbulk.NewSink(bcfg, logger).Write(ctx, deletes)
+	}
+
+	var err error
+	res.Source, res.Destination, err = extraDocs(ctx, src, des, logger, logevery, func(ddoc *estypes.Doc) error {
+		res.Extra++
+		if dryRun {
+			logger.Infof("would delete %s", ddoc.ID)
+			res.IDs = append(res.IDs, ddoc.ID)
+			return nil
+		}
+		select {
+		case deletes <- &estypes.Doc{Meta: ddoc.Meta, Delete: true}:
+			return nil
+		case err := <-idxerr:
+			return fmt.Errorf("error deleting: %v", err)
+		}
+	})
+	close(deletes)
+	if err != nil {
+		// stop deleting and wait for the deletes already sent
+		if !dryRun {
+			can()
+			<-idxerr
+		}
+		return res, err
+	}
+
+	if !dryRun {
+		if err := <-idxerr; err != nil {
+			return res, fmt.Errorf("error deleting: %v", err)
+		}
+		res.Deleted = res.Extra
+		if bcfg.DeadLetter != nil {
+			if err := bcfg.DeadLetter.Close(); err != nil {
+				logger.Errorf("error closing dead-letter file: %v", err)
+			}
+			res.Deleted -= int(bcfg.DeadLetter.Count())
+		}
+	}
+	logger.Infof("reconcile completed: %v", res)
+	if dryRun {
+		return res, nil
+	}
+	return res, deadLettered(bcfg, logger)
+}
+
+// extraDocs reads the ids of the source and destination indexes sorted by _id
+// and calls extra with the metadata of every destination document that isn't
+// in the source. Returns the number of source and destination documents read.
+func extraDocs(ctx context.Context, src *SourceConfig, des *DesConfig, logger log.Logger, logevery time.Duration, extra func(*estypes.Doc) error) (int, int, error) {
+	ssrc, dsrc := sortedSources(src, des, true)
+
+	ctx, can := context.WithCancel(ctx)
+	defer can()
+	sresp, err := ssrc.Source(ctx, logger, logevery).Start()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading source ids: %v", err)
+	}
+	dresp, err := dsrc.Source(ctx, logger, logevery).Start()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading destination ids: %v", err)
+	}
+	logger.Infof("Comparing the ids of %d source documents with %d destination documents", sresp.Total, dresp.Total)
+
+	// an unfinished read must not be taken as missing documents
+	next := func(resp *pipeline.Response, name string) func() (*estypes.Doc, error) {
+		return func() (*estypes.Doc, error) {
+			if doc, ok := <-resp.Hits; ok {
+				return doc, nil
+			}
+			if err := resp.Err(); err != nil {
+				return nil, fmt.Errorf("error reading %s ids: %v", name, err)
+			}
+			return nil, ctx.Err()
+		}
+	}
+	return mergeSorted(
+		esdiff.NewSortedReader("source", true, next(sresp, "source")),
+		esdiff.NewSortedReader("destination", !des.Typeless, next(dresp, "destination")),
+		extra,
+	)
+}
+
+// mergeSorted merges the source and destination documents read sorted by _id,
+// calling extra with every destination document that isn't in the source.
+// Documents with the same _id are told apart by their type if dst is typed,
+// since indexes with several types can repeat ids. Returns the number of
+// source and destination documents read.
+//
+// Each document is checked to be in order before it's used, so an unsorted
+// stream fails instead of making live documents look extra.
+func mergeSorted(src, dst *esdiff.SortedReader, extra func(*estypes.Doc) error) (int, int, error) {
+	sgroup, err := src.Group()
+	if err != nil {
+		return src.N(), dst.N(), err
+	}
+	for {
+		dgroup, err := dst.Group()
+		if err != nil {
+			return src.N(), dst.N(), err
+		}
+		if dgroup == nil {
+			break
+		}
+		id := dgroup[0].ID
+		for sgroup != nil && sgroup[0].ID < id {
+			if sgroup, err = src.Group(); err != nil {
+				return src.N(), dst.N(), err
+			}
+		}
+		for _, ddoc := range dgroup {
+			if sgroup != nil && sgroup[0].ID == id && (!dst.Typed() || esdiff.HasType(sgroup, ddoc.Type)) {
+				continue
+			}
+			if err := extra(ddoc); err != nil {
+				return src.N(), dst.N(), err
+			}
+		}
+	}
+	// read the rest of the source to make sure it ended successfully
+	for sgroup != nil {
+		if sgroup, err = src.Group(); err != nil {
+			return src.N(), dst.N(), err
+		}
+	}
+	return src.N(), dst.N(), nil
+}
+
+// sortedSources returns copies of src reading the source and destination
+// indexes from the start sorted by _id, without their sources if noSource.
+func sortedSources(src *SourceConfig, des *DesConfig, noSource bool) (*SourceConfig, *SourceConfig) {
+	ssrc := *src
+	ssrc.Sorted = true
+	ssrc.After = nil
+	ssrc.NoSource = noSource
+	dsrc := ssrc
+	dsrc.IndexName = des.IndexName
+	dsrc.Host = des.Hosts[0]
+	dsrc.Filter = nil
+	dsrc.PIT = false
+	dsrc.TrackTotalHits = des.Typeless
+	return &ssrc, &dsrc
+}
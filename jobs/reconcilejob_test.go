@@ -0,0 +1,150 @@
+package jobs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lytics/escp/esdiff"
+	"github.com/lytics/escp/estypes"
+)
+
+// docs parses "type/id" or "id" strings into documents.
+func docs(ids ...string) []*estypes.Doc {
+	out := make([]*estypes.Doc, len(ids))
+	for i, id := range ids {
+		doc := &estypes.Doc{}
+		if parts := strings.SplitN(id, "/", 2); len(parts) == 2 {
+			doc.Type, doc.ID = parts[0], parts[1]
+		} else {
+			doc.ID = id
+		}
+		out[i] = doc
+	}
+	return out
+}
+
+func reader(name string, typed bool, ds []*estypes.Doc) *esdiff.SortedReader {
+	return esdiff.NewSortedReader(name, typed, func() (*estypes.Doc, error) {
+		if len(ds) == 0 {
+			return nil, nil
+		}
+		doc := ds[0]
+		ds = ds[1:]
+		return doc, nil
+	})
+}
+
+func TestMergeSorted(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst []*estypes.Doc
+		typed    bool     // destination is typed
+		extra    []string // ids passed to extra before any error
+		srcn     int
+		desn     int
+		err      string // substring of the expected error
+	}{
+		{name: "empty"},
+		{name: "equal", src: docs("a", "b", "c"), dst: docs("a", "b", "c"), srcn: 3, desn: 3},
+		{name: "empty source", dst: docs("a", "b"), extra: []string{"a", "b"}, desn: 2},
+		{name: "empty destination", src: docs("a", "b"), srcn: 2},
+		{
+			name:  "extra interleaved",
+			src:   docs("b", "d", "f"),
+			dst:   docs("a", "b", "c", "d", "e", "f", "g"),
+			extra: []string{"a", "c", "e", "g"},
+			srcn:  3, desn: 7,
+		},
+		{name: "missing from destination", src: docs("a", "b", "c", "d"), dst: docs("b", "d"), srcn: 4, desn: 2},
+		{
+			name:  "bytewise order",
+			src:   docs("B", "a", "b"),
+			dst:   docs("A", "B", "a", "aa", "b"),
+			extra: []string{"A", "aa"},
+			srcn:  3, desn: 5,
+		},
+		{
+			name:  "destination out of order",
+			src:   docs("a", "b", "c"),
+			dst:   docs("a", "c", "b"),
+			extra: []string{},
+			srcn:  2, desn: 3,
+			err: `destination isn't sorted by _id: "b" read after "c"`,
+		},
+		{
+			name:  "source out of order",
+			src:   docs("a", "c", "b", "d"),
+			dst:   docs("a", "b", "d"),
+			extra: []string{},
+			srcn:  3, desn: 3,
+			err: `source isn't sorted by _id: "b" read after "c"`,
+		},
+		{
+			name:  "duplicate destination id",
+			src:   docs("a", "b"),
+			dst:   docs("a", "a", "b"),
+			extra: []string{},
+			srcn:  2, desn: 2,
+			err: `destination has document "a"`,
+		},
+		{
+			name:  "duplicate source id",
+			src:   docs("a", "a"),
+			dst:   docs("a"),
+			extra: []string{},
+			srcn:  2, desn: 0,
+			err: `source has document "a"`,
+		},
+		{
+			name:  "typed ids repeated across types",
+			src:   docs("t1/a", "t2/a", "t1/b"),
+			dst:   docs("t2/a", "t1/a", "t3/a", "t1/b", "t2/b"),
+			typed: true,
+			extra: []string{"t3/a", "t2/b"},
+			srcn:  3, desn: 5,
+		},
+		{
+			name:  "typed duplicate of type and id",
+			src:   docs("t1/a"),
+			dst:   docs("t1/a", "t1/a"),
+			typed: true,
+			extra: []string{},
+			srcn:  1, desn: 2,
+			err: `destination has document "a" of type "t1" more than once`,
+		},
+		{
+			name: "typed source into typeless destination",
+			src:  docs("t1/a", "t2/a", "t1/b"),
+			dst:  docs("_doc/a", "_doc/b"),
+			srcn: 3, desn: 2,
+		},
+	}
+	for _, tc := range tests {
+		extra := []string{}
+		srcn, desn, err := mergeSorted(reader("source", true, tc.src), reader("destination", tc.typed, tc.dst), func(doc *estypes.Doc) error {
+			if doc.Type != "" && tc.typed {
+				extra = append(extra, doc.Type+"/"+doc.ID)
+			} else {
+				extra = append(extra, doc.ID)
+			}
+			return nil
+		})
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected error %q but got: %v", tc.name, tc.err, err)
+		}
+		want := tc.extra
+		if want == nil {
+			want = []string{}
+		}
+		if !reflect.DeepEqual(extra, want) {
+			t.Errorf("%s: extra %v != %v", tc.name, extra, want)
+		}
+		if srcn != tc.srcn || desn != tc.desn {
+			t.Errorf("%s: read %d/%d documents; expected %d/%d", tc.name, srcn, desn, tc.srcn, tc.desn)
+		}
+	}
+}
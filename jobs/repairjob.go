@@ -0,0 +1,155 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lytics/escp/esbulk"
+	"github.com/lytics/escp/esdiff"
+	"github.com/lytics/escp/esindex"
+	"github.com/lytics/escp/estypes"
+	log "github.com/lytics/escp/logging"
+)
+
+// RepairResults of a Repair.
+type RepairResults struct {
+	Requested   int            `json:"requested"`           // missing and mismatched documents to repair
+	NotInSource int            `json:"not_in_source"`       // documents deleted from the source since they were validated
+	Indexed     int            `json:"indexed"`             // documents re-indexed, less those dead-lettered
+	Fixed       int            `json:"fixed"`               // documents that matched when checked again
+	Remaining   []*esdiff.Diff `json:"remaining,omitempty"` // differences still found when checked again
+	SourceCount uint64         `json:"source_count"`        // documents in the source index after repairing
+	DesCount    uint64         `json:"destination_count"`   // documents in the destination index after repairing
+}
+
+func (r *RepairResults) String() string {
+	return fmt.Sprintf("requested=%d not_in_source=%d indexed=%d fixed=%d remaining=%d counts=%d/%d",
+		r.Requested, r.NotInSource, r.Indexed, r.Fixed, len(r.Remaining), r.SourceCount, r.DesCount)
+}
+
+// Repair re-copies the missing and mismatched documents of diffs, such as
+// the Details of a Validate, from the source to the destination and then
+// checks them again with opts.Rules. Other differences, like extra
+// documents, are left for Reconcile.
+func Repair(ctx context.Context, src *SourceConfig, des *DesConfig, diffs []*esdiff.Diff, opts *ValidateOptions, logger log.Logger, logevery time.Duration) (*RepairResults, error) {
+	res := &RepairResults{}
+	if err := src.DetectVersion(logger); err != nil {
+		return res, err
+	}
+	if err := des.DetectVersion(logger); err != nil {
+		return res, err
+	}
+	batchsz := opts.BatchSize
+	if batchsz < 1 {
+		batchsz = 100
+	}
+	srcUrl := src.URL()
+	desIdxUrl := fmt.Sprintf("%s/%s", des.Hosts[0], des.IndexName)
+
+	// the documents to repair, once each
+	seen := map[string]bool{}
+	docs := []*estypes.Doc{}
+	for _, d := range diffs {
+		if d.Kind != esdiff.DiffMissing && d.Kind != esdiff.DiffSource {
+			continue
+		}
+		if seen[d.Type+"/"+d.ID] {
+			continue
+		}
+		seen[d.Type+"/"+d.ID] = true
+		docs = append(docs, d.Doc())
+	}
+	res.Requested = len(docs)
+	if len(docs) == 0 {
+		return res, res.count(srcUrl, desIdxUrl)
+	}
+	logger.Infof("Repairing %d documents from %v", len(docs), srcUrl)
+
+	// fetch them from the source
+	found := make([]*estypes.Doc, 0, len(docs))
+	for i := 0; i < len(docs); i += batchsz {
+		end := i + batchsz
+		if end > len(docs) {
+			end = len(docs)
+		}
+		got, err := esindex.MultiGet(srcUrl, docs[i:end], false)
+		if err != nil {
+			return res, fmt.Errorf("error getting source documents: %v", err)
+		}
+		for j, doc := range got {
+			if doc == nil {
+				logger.Warnf("%s is no longer in the source", docs[i+j].ID)
+				res.NotInSource++
+				continue
+			}
+			found = append(found, doc)
+		}
+	}
+
+	// re-index them
+	ctx, can := context.WithCancel(ctx)
+	defer can()
+	bcfg := des.BulkConfig()
+	bcfg.LogEvery = logevery
+	writes := make(chan *estypes.Doc, 1000)
+	idxerr := esbulk.NewSink(bcfg, logger).Write(ctx, writes)
+	for _, doc := range found {
+		select {
+		case writes <- doc:
+		case err := <-idxerr:
+			return res, fmt.Errorf("error indexing: %v", err)
+		}
+	}
+	close(writes)
+	if err := <-idxerr; err != nil {
+		return res, fmt.Errorf("error indexing: %v", err)
+	}
+	res.Indexed = len(found)
+	if bcfg.DeadLetter != nil {
+		if err := bcfg.DeadLetter.Close(); err != nil {
+			logger.Errorf("error closing dead-letter file: %v", err)
+		}
+		res.Indexed -= int(bcfg.DeadLetter.Count())
+	}
+
+	// and check them again; gets are realtime so no refresh is needed
+	for i := 0; i < len(found); i += batchsz {
+		end := i + batchsz
+		if end > len(found) {
+			end = len(found)
+		}
+		diffs, err := esdiff.CheckBatch(found[i:end], desIdxUrl, des.Typeless, opts.Rules, logger)
+		if err != nil {
+			return res, fmt.Errorf("error checking repaired documents: %v", err)
+		}
+		for _, diff := range diffs {
+			if diff == nil {
+				res.Fixed++
+				continue
+			}
+			res.Remaining = append(res.Remaining, diff)
+		}
+	}
+	if err := res.count(srcUrl, desIdxUrl); err != nil {
+		return res, err
+	}
+	logger.Infof("repair completed: %v", res)
+	return res, deadLettered(bcfg, logger)
+}
+
+// count the documents of the indexes after refreshing the destination so the
+// repaired documents are counted.
+func (r *RepairResults) count(srcUrl, desIdxUrl string) error {
+	if err := esindex.Refresh(desIdxUrl); err != nil {
+		return fmt.Errorf("error refreshing destination: %v", err)
+	}
+	var err error
+	if r.SourceCount, err = esindex.GetDocCount(srcUrl); err != nil {
+		return fmt.Errorf("error getting src doc count: %v", err)
+	}
+	if r.DesCount, err = esindex.GetDocCount(desIdxUrl); err != nil {
+		return fmt.Errorf("error getting des doc count: %v", err)
+	}
+	return nil
+}
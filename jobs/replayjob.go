@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lytics/escp/esbulk"
+	log "github.com/lytics/escp/logging"
+	"github.com/lytics/escp/pipeline"
+)
+
+// ReplayDeadLetters retries the documents of a dead-letter file against the
+// destination index, refusing files with documents for other indexes.
+// Documents that fail again are written to des.DeadLetter, which must be a
+// different file, and ErrDeadLettered is returned.
+func ReplayDeadLetters(ctx context.Context, path string, des *DesConfig, logger log.Logger) error {
+	if des.DeadLetter == path {
+		return fmt.Errorf("cannot replay dead-letter file %s into itself", path)
+	}
+
+	if err := des.DetectVersion(logger); err != nil {
+		return err
+	}
+
+	st := time.Now()
+	bcfg := des.BulkConfig()
+	source := esbulk.NewDeadLetterSource(path, 1000)
+	source.Index = des.IndexName
+	resp, err := pipeline.Pipe(ctx, source, esbulk.NewSink(bcfg, logger))
+	if bcfg.DeadLetter != nil {
+		if err := bcfg.DeadLetter.Close(); err != nil {
+			logger.Errorf("error closing dead-letter file: %v", err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error replaying dead-letter file %s: %v", path, err)
+	}
+
+	logger.Infof("replayed %d documents from %s to %s in %v", resp.Total, path, des.PrimaryURL(), time.Since(st))
+	return deadLettered(bcfg, logger)
+}
@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lytics/escp/esindex"
+	log "github.com/lytics/escp/logging"
+)
+
+// ReplicateConfig configures a Replicator.
+type ReplicateConfig struct {
+	SyncConfig
+	Interval time.Duration // time between the start of sync passes; 0 = 1m
+}
+
+// ReplicationStatus of a Replicator.
+type ReplicationStatus struct {
+	Passes          int             `json:"passes"`            // successful passes since starting
+	Failures        int             `json:"failures"`          // failed passes since starting
+	DeadLettered    int             `json:"dead_lettered"`     // successful passes that dead-lettered documents
+	HighWater       json.RawMessage `json:"high_water"`        // mark the destination is synced up to
+	SourceHighWater json.RawMessage `json:"source_high_water"` // largest value of the field in the source
+	Lag             time.Duration   `json:"lag_ns"`            // SourceHighWater - HighWater if the field is a date or epoch milliseconds, otherwise 0
+	LastPass        time.Time       `json:"last_pass"`         // when the last successful pass finished
+	LastError       string          `json:"last_error,omitempty"`
+}
+
+// Replicator keeps a destination index in sync with a live source index by
+// running a Sync pass every interval.
+type Replicator struct {
+	src      *SourceConfig
+	des      *DesConfig
+	cfg      *ReplicateConfig
+	logger   log.Logger
+	logevery time.Duration
+
+	mu     sync.Mutex
+	status ReplicationStatus
+}
+
+func NewReplicator(src *SourceConfig, des *DesConfig, cfg *ReplicateConfig, logger log.Logger, logevery time.Duration) *Replicator {
+	return &Replicator{src: src, des: des, cfg: cfg, logger: logger, logevery: logevery}
+}
+
+// Status of the replication so far.
+func (r *Replicator) Status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Run sync passes until ctx is done. Failed passes are logged and retried at
+// the next interval; only errors reading the state file stop replication.
+// Passes that dead-lettered documents still count, since those documents are
+// recorded in the dead-letter file instead of being retried every pass.
+//
+// When ctx is done in the middle of a pass, the bulk uploads already started
+// are finished and, if the source is Sorted, the pass's progress is saved so
+// the next Run resumes it; otherwise the pass is redone from the last saved
+// high-water mark.
+func (r *Replicator) Run(ctx context.Context) error {
+	interval := r.cfg.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	srcUrl := r.src.URL()
+	key := syncKey(srcUrl, r.des.PrimaryURL())
+
+	for {
+		st := time.Now()
+		err := Sync(ctx, r.src, r.des, &r.cfg.SyncConfig, r.logger, r.logevery)
+		if ctx.Err() != nil {
+			if err != nil {
+				r.logger.Infof("replication stopped: %v", err)
+			} else {
+				r.logger.Infof("replication stopped")
+			}
+			return nil
+		}
+
+		states, lerr := LoadSyncStates(r.cfg.State)
+		if lerr != nil {
+			return lerr
+		}
+		srcmax, merr := esindex.GetMax(srcUrl, r.cfg.Field)
+
+		r.mu.Lock()
+		if err == ErrDeadLettered {
+			r.status.DeadLettered++
+			r.logger.Warnf("sync pass dead-lettered documents; they won't be retried by later passes")
+			err = nil
+		}
+		if err != nil {
+			r.status.Failures++
+			r.status.LastError = err.Error()
+			r.logger.Errorf("sync pass failed: %v", err)
+		} else {
+			r.status.Passes++
+			r.status.LastError = ""
+			r.status.LastPass = time.Now()
+		}
+		if state := states[key]; state != nil {
+			r.status.HighWater = state.HighWater
+		}
+		if merr != nil {
+			r.logger.Warnf("error getting source high-water mark: %v", merr)
+		} else {
+			r.status.SourceHighWater = srcmax
+			r.status.Lag = lag(r.status.HighWater, srcmax)
+		}
+		r.logger.Infof("replication passes:%d failures:%d high-water:%s source:%s lag:%v",
+			r.status.Passes, r.status.Failures, string(r.status.HighWater), string(r.status.SourceHighWater), r.status.Lag)
+		r.mu.Unlock()
+
+		select {
+		case <-time.After(interval - time.Since(st)):
+		case <-ctx.Done():
+			r.logger.Infof("replication stopped")
+			return nil
+		}
+	}
+}
+
+// lag between two high-water marks of a date or numeric field; 0 if they
+// aren't either.
+func lag(from, to json.RawMessage) time.Duration {
+	ft, ok := markTime(from)
+	if !ok {
+		return 0
+	}
+	tt, ok := markTime(to)
+	if !ok || tt.Before(ft) {
+		return 0
+	}
+	return tt.Sub(ft)
+}
+
+// markTime parses a high-water mark that is a formatted date, or a number or
+// string of epoch milliseconds such as the mark of a numeric field.
+func markTime(mark json.RawMessage) (time.Time, bool) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(mark))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return time.Time{}, false
+	}
+	var ms json.Number
+	switch v := v.(type) {
+	case json.Number:
+		ms = v
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		ms = json.Number(v)
+	default:
+		return time.Time{}, false
+	}
+	f, err := ms.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Millisecond))), true
+}
+
+func (s ReplicationStatus) String() string {
+	return fmt.Sprintf("passes:%d failures:%d dead-lettered:%d lag:%v", s.Passes, s.Failures, s.DeadLettered, s.Lag)
+}
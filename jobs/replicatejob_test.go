@@ -0,0 +1,52 @@
+package jobs
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMarkTime(t *testing.T) {
+	tests := []struct {
+		mark string
+		want time.Time
+		ok   bool
+	}{
+		{mark: `"2021-06-01T12:00:00Z"`, want: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), ok: true},
+		{mark: `"2021-06-01T12:00:00.123+02:00"`, want: time.Date(2021, 6, 1, 10, 0, 0, 123e6, time.UTC), ok: true},
+		{mark: `1622548800000`, want: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), ok: true},
+		{mark: `1.5`, want: time.Unix(0, 15e5), ok: true},
+		{mark: `"1622548800000"`, want: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), ok: true},
+		{mark: `0`, want: time.Unix(0, 0), ok: true},
+		{mark: `"yesterday"`},
+		{mark: `null`},
+		{mark: `true`},
+		{mark: `[1]`},
+		{mark: ``},
+	}
+	for _, tc := range tests {
+		got, ok := markTime(json.RawMessage(tc.mark))
+		if ok != tc.ok || ok && !got.Equal(tc.want) {
+			t.Errorf("%s: %v %t; expected %v %t", tc.mark, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestLag(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     time.Duration
+	}{
+		{from: `"2021-06-01T12:00:00Z"`, to: `"2021-06-01T12:01:30Z"`, want: 90 * time.Second},
+		{from: `1622548800000`, to: `1622548805000`, want: 5 * time.Second},
+		{from: `1622548800000`, to: `"2021-06-01T12:00:01Z"`, want: time.Second},
+		{from: `"2021-06-01T12:01:00Z"`, to: `"2021-06-01T12:00:00Z"`},
+		{from: `null`, to: `"2021-06-01T12:00:00Z"`},
+		{from: `"2021-06-01T12:00:00Z"`, to: `"soon"`},
+	}
+	for _, tc := range tests {
+		if got := lag(json.RawMessage(tc.from), json.RawMessage(tc.to)); got != tc.want {
+			t.Errorf("lag from %s to %s: %v; expected %v", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
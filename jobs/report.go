@@ -0,0 +1,178 @@
+package jobs
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/lytics/escp/esdiff"
+)
+
+// Results of a validation in a report.
+const (
+	ResultMatch    = "match"
+	ResultMismatch = "mismatch"
+	ResultError    = "error"
+)
+
+// Report formats.
+const (
+	ReportJSON  = "json"
+	ReportJUnit = "junit"
+)
+
+// ValidationReport is the outcome of a Validate for machines such as CI to
+// read.
+type ValidationReport struct {
+	*ValidationResults
+	Result string         `json:"result"`           // ResultMatch, ResultMismatch or ResultError
+	Error  string         `json:"error,omitempty"`  // if ResultError
+	Repair *RepairResults `json:"repair,omitempty"` // if the differences were repaired
+}
+
+// NewValidationReport from what Validate returned.
+func NewValidationReport(vr *ValidationResults, err error) *ValidationReport {
+	if vr == nil {
+		vr = &ValidationResults{}
+	}
+	r := &ValidationReport{ValidationResults: vr, Result: ResultMatch}
+	switch {
+	case err == ErrMissMatch:
+		r.Result = ResultMismatch
+	case err != nil:
+		r.Result = ResultError
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Repaired records the results of repairing the differences found. The result
+// becomes ResultMatch if nothing remains to repair, no extra documents were
+// found and the document counts now agree, otherwise ResultMismatch.
+func (r *ValidationReport) Repaired(rr *RepairResults) {
+	r.Repair = rr
+	r.Result = ResultMismatch
+	if len(rr.Remaining) == 0 && r.Extra == 0 && rr.SourceCount == rr.DesCount {
+		r.Result = ResultMatch
+	}
+}
+
+// Write the report to w in format, ReportJSON or ReportJUnit.
+func (r *ValidationReport) Write(w io.Writer, format string) error {
+	switch format {
+	case ReportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case ReportJUnit:
+		if _, err := io.WriteString(w, xml.Header); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(r.junit()); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	default:
+		return fmt.Errorf("unknown report format %q", format)
+	}
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Time       float64         `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr,omitempty"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitCase     `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Output    string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+// junit converts the report to a suite with a case for the document count,
+// one for the matched documents and one failing case per difference found.
+func (r *ValidationReport) junit() *junitSuites {
+	vr := r.ValidationResults
+	suite := junitSuite{
+		Name: fmt.Sprintf("esdiff %s %s", vr.Source, vr.Destination),
+		Time: vr.Duration.Seconds(),
+		Properties: []junitProperty{
+			{Name: "sample_rate", Value: fmt.Sprintf("1/%d", vr.Denom)},
+			{Name: "seed", Value: fmt.Sprint(vr.Seed)},
+			{Name: "total", Value: fmt.Sprint(vr.Total)},
+			{Name: "checked", Value: fmt.Sprint(vr.Checked)},
+		},
+	}
+	strata := make([]string, 0, len(vr.Strata))
+	for stratum := range vr.Strata {
+		strata = append(strata, stratum)
+	}
+	sort.Strings(strata)
+	for _, stratum := range strata {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "stratum:" + stratum, Value: vr.Strata[stratum].String()})
+	}
+	if r.Repair != nil {
+		suite.Properties = append(suite.Properties,
+			junitProperty{Name: "repair_fixed", Value: fmt.Sprint(r.Repair.Fixed)},
+			junitProperty{Name: "repair_remaining", Value: fmt.Sprint(len(r.Repair.Remaining))},
+		)
+	}
+	if !vr.Started.IsZero() {
+		suite.Timestamp = vr.Started.UTC().Format("2006-01-02T15:04:05")
+	}
+
+	count := junitCase{Name: "document count", ClassName: "esdiff.count"}
+	docs := []junitCase{}
+	for _, d := range vr.Details {
+		if d.Kind == esdiff.DiffCount {
+			count.Failure = &junitMessage{Message: d.String(), Type: d.Kind}
+			continue
+		}
+		docs = append(docs, junitCase{
+			Name:      d.ID,
+			ClassName: "esdiff.document",
+			Failure:   &junitMessage{Message: d.Kind, Type: d.Kind, Body: d.String()},
+		})
+	}
+	matched := junitCase{Name: "matched documents", ClassName: "esdiff.document", Output: vr.String()}
+	if r.Result == ResultError {
+		matched.Error = &junitMessage{Message: r.Error}
+		suite.Errors = 1
+	}
+	suite.Cases = append([]junitCase{count, matched}, docs...)
+	suite.Tests = len(suite.Cases)
+	for _, c := range suite.Cases {
+		if c.Failure != nil {
+			suite.Failures++
+		}
+	}
+	return &junitSuites{Suites: []junitSuite{suite}}
+}
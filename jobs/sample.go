@@ -0,0 +1,169 @@
+package jobs
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/lytics/escp/estypes"
+)
+
+// sampler picks the source documents Validate checks. Documents are picked
+// by a hash of their seed and _id, so runs with the same seed check the same
+// documents. So small strata aren't under-sampled, strata with fewer than
+// minimum documents picked are topped up with their unpicked documents with
+// the lowest hashes, a bottom-k sample that doesn't depend on the read order.
+// Only the metadata of those documents is kept, so their sources have to be
+// read again to check them.
+type sampler struct {
+	seed    []byte
+	denom   uint64
+	strata  string // "_type" or a source field to stratify by; "" for none
+	minimum int
+
+	seen    map[string]int         // documents read per stratum
+	sampled map[string]int         // documents picked per stratum
+	lowest  map[string]*hashedDocs // up to minimum unpicked documents with the lowest hashes per stratum
+}
+
+func newSampler(seed int64, denom int, strata string, minimum int) *sampler {
+	s := &sampler{
+		seed:    make([]byte, 8),
+		denom:   uint64(denom),
+		strata:  strata,
+		minimum: minimum,
+		seen:    map[string]int{},
+		sampled: map[string]int{},
+		lowest:  map[string]*hashedDocs{},
+	}
+	binary.LittleEndian.PutUint64(s.seed, uint64(seed))
+	return s
+}
+
+// sample returns doc's stratum and whether it should be checked.
+func (s *sampler) sample(doc *estypes.Doc) (string, bool) {
+	stratum := s.stratum(doc)
+	s.seen[stratum]++
+	if s.denom > 1 {
+		h := s.hash(doc)
+		if h%s.denom != 0 {
+			if s.strata != "" && s.minimum > 0 {
+				s.keep(stratum, hashedDoc{hash: h, doc: &estypes.Doc{Meta: doc.Meta}})
+			}
+			return stratum, false
+		}
+	}
+	s.sampled[stratum]++
+	return stratum, true
+}
+
+// extra returns the metadata of the documents to check, and their strata, to
+// top up the strata with fewer than minimum documents picked once every
+// document has been sampled.
+func (s *sampler) extra() ([]*estypes.Doc, []string) {
+	strata := make([]string, 0, len(s.lowest))
+	for stratum := range s.lowest {
+		strata = append(strata, stratum)
+	}
+	sort.Strings(strata)
+	docs, docstrata := []*estypes.Doc{}, []string{}
+	for _, stratum := range strata {
+		lowest := *s.lowest[stratum]
+		sort.Slice(lowest, func(i, j int) bool { return lowest[i].less(lowest[j]) })
+		for _, hd := range lowest {
+			if s.sampled[stratum] >= s.minimum {
+				break
+			}
+			docs = append(docs, hd.doc)
+			docstrata = append(docstrata, stratum)
+			s.sampled[stratum]++
+		}
+	}
+	s.lowest = map[string]*hashedDocs{}
+	return docs, docstrata
+}
+
+func (s *sampler) hash(doc *estypes.Doc) uint64 {
+	h := fnv.New64a()
+	h.Write(s.seed)
+	h.Write([]byte(doc.ID))
+	return h.Sum64()
+}
+
+// keep hd if it's one of the minimum unpicked documents of stratum with the
+// lowest hashes so far.
+func (s *sampler) keep(stratum string, hd hashedDoc) {
+	lowest := s.lowest[stratum]
+	if lowest == nil {
+		lowest = &hashedDocs{}
+		s.lowest[stratum] = lowest
+	}
+	switch {
+	case lowest.Len() < s.minimum:
+		heap.Push(lowest, hd)
+	case hd.less((*lowest)[0]):
+		(*lowest)[0] = hd
+		heap.Fix(lowest, 0)
+	}
+}
+
+// hashedDoc is a document's metadata and the hash it was sampled by.
+type hashedDoc struct {
+	hash uint64
+	doc  *estypes.Doc
+}
+
+// less orders documents by hash, then _id in case hashes collide.
+func (h hashedDoc) less(o hashedDoc) bool {
+	if h.hash != o.hash {
+		return h.hash < o.hash
+	}
+	return h.doc.ID < o.doc.ID
+}
+
+// hashedDocs is a heap with the highest hash on top.
+type hashedDocs []hashedDoc
+
+func (h hashedDocs) Len() int            { return len(h) }
+func (h hashedDocs) Less(i, j int) bool  { return h[j].less(h[i]) }
+func (h hashedDocs) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *hashedDocs) Push(x interface{}) { *h = append(*h, x.(hashedDoc)) }
+func (h *hashedDocs) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// stratum of doc; documents without the strata field are in the "" stratum.
+func (s *sampler) stratum(doc *estypes.Doc) string {
+	switch s.strata {
+	case "":
+		return ""
+	case "_type":
+		return doc.Type
+	}
+	var v interface{}
+	if err := json.Unmarshal(doc.Source, &v); err != nil {
+		return ""
+	}
+	for _, k := range strings.Split(s.strata, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = obj[k]
+	}
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
@@ -0,0 +1,120 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/lytics/escp/estypes"
+)
+
+func TestSampler(t *testing.T) {
+	tests := []struct {
+		name    string
+		denom   int
+		strata  string
+		minimum int
+		sizes   map[string]int // documents per type
+	}{
+		{name: "every document", denom: 1, sizes: map[string]int{"t": 50}},
+		{name: "unstratified", denom: 10, sizes: map[string]int{"t": 200}},
+		{name: "stratified without minimum", denom: 10, strata: "_type", sizes: map[string]int{"a": 200, "b": 5}},
+		{name: "small stratum topped up", denom: 50, strata: "_type", minimum: 3, sizes: map[string]int{"big": 500, "small": 10}},
+		{name: "stratum smaller than minimum", denom: 50, strata: "_type", minimum: 20, sizes: map[string]int{"big": 500, "small": 5}},
+		{name: "many strata", denom: 100, strata: "_type", minimum: 2, sizes: map[string]int{"a": 30, "b": 30, "c": 30, "d": 1}},
+	}
+	for _, tc := range tests {
+		var all []*estypes.Doc
+		for typ, n := range tc.sizes {
+			for i := 0; i < n; i++ {
+				doc := &estypes.Doc{Source: json.RawMessage(`{}`)}
+				doc.ID, doc.Type = fmt.Sprintf("%s%d", typ, i), typ
+				all = append(all, doc)
+			}
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+
+		// pick the documents read in the order of idx, returning the
+		// stratum:id of those picked, and how many of each stratum were
+		// picked by hash and in all.
+		pick := func(idx func(i int) int) (picked []string, byhash, total map[string]int) {
+			s := newSampler(42, tc.denom, tc.strata, tc.minimum)
+			byhash, total = map[string]int{}, map[string]int{}
+			for i := range all {
+				doc := all[idx(i)]
+				if stratum, ok := s.sample(doc); ok {
+					picked = append(picked, stratum+":"+doc.ID)
+					byhash[stratum]++
+					total[stratum]++
+				}
+			}
+			extra, strata := s.extra()
+			for i, doc := range extra {
+				if doc.Source != nil {
+					t.Errorf("%s: top-up %s kept its source", tc.name, doc.ID)
+				}
+				picked = append(picked, strata[i]+":"+doc.ID)
+				total[strata[i]]++
+			}
+			sort.Strings(picked)
+			return picked, byhash, total
+		}
+		forward, byhash, total := pick(func(i int) int { return i })
+		reverse, _, _ := pick(func(i int) int { return len(all) - 1 - i })
+		perm := rand.New(rand.NewSource(1)).Perm(len(all))
+		shuffled, _, _ := pick(func(i int) int { return perm[i] })
+		if !reflect.DeepEqual(forward, reverse) || !reflect.DeepEqual(forward, shuffled) {
+			t.Errorf("%s: picks depend on read order: %v, %v, %v", tc.name, forward, reverse, shuffled)
+		}
+		if tc.denom == 1 && len(forward) != len(all) {
+			t.Errorf("%s: picked %d of %d documents", tc.name, len(forward), len(all))
+		}
+		if tc.strata == "" {
+			continue
+		}
+		for stratum, n := range tc.sizes {
+			want := byhash[stratum]
+			if min := tc.minimum; want < min {
+				if n < min {
+					min = n
+				}
+				want = min
+			}
+			if total[stratum] != want {
+				t.Errorf("%s: picked %d documents of %s; expected %d", tc.name, total[stratum], stratum, want)
+			}
+		}
+	}
+}
+
+func TestSamplerStratum(t *testing.T) {
+	tests := []struct {
+		strata string
+		typ    string
+		source string
+		want   string
+	}{
+		{strata: "", typ: "t", source: `{"a":"x"}`, want: ""},
+		{strata: "_type", typ: "t", source: `{"a":"x"}`, want: "t"},
+		{strata: "a", source: `{"a":"x"}`, want: "x"},
+		{strata: "a", source: `{"a":12}`, want: "12"},
+		{strata: "a", source: `{"a":true}`, want: "true"},
+		{strata: "a", source: `{"a":["x","y"]}`, want: `["x","y"]`},
+		{strata: "a", source: `{"a":null}`, want: ""},
+		{strata: "a", source: `{"b":"x"}`, want: ""},
+		{strata: "user.country", source: `{"user":{"country":"nz"}}`, want: "nz"},
+		{strata: "user.country", source: `{"user":"nz"}`, want: ""},
+		{strata: "a", source: `not json`, want: ""},
+	}
+	for _, tc := range tests {
+		s := newSampler(0, 1, tc.strata, 0)
+		doc := &estypes.Doc{Source: json.RawMessage(tc.source)}
+		doc.Type = tc.typ
+		if got := s.stratum(doc); got != tc.want {
+			t.Errorf("stratum %q of %s: %q; expected %q", tc.strata, tc.source, got, tc.want)
+		}
+	}
+}
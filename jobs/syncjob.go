@@ -0,0 +1,206 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/lytics/escp/esindex"
+	log "github.com/lytics/escp/logging"
+)
+
+// SyncConfig configures the incremental passes of Sync.
+type SyncConfig struct {
+	Field   string // timestamp field that is updated whenever a document changes
+	State   string // file to keep the high-water mark of each source and destination pair in
+	Overlap string // date math subtracted from the high-water mark to catch documents that weren't searchable yet, e.g. "5m"; only for date fields
+}
+
+// SyncState is the high-water mark of the syncs from a source to a
+// destination index. Every source document with Field below HighWater has
+// been copied.
+type SyncState struct {
+	Source      string          `json:"source"`
+	Destination string          `json:"destination"`
+	Field       string          `json:"field"`
+	HighWater   json.RawMessage `json:"high_water,omitempty"`
+	Passes      int             `json:"passes"`
+	Pass        *SyncPass       `json:"pass,omitempty"` // the pass that was interrupted, if any
+	Updated     time.Time       `json:"updated"`
+}
+
+// SyncPass is the progress of a pass that was interrupted before it
+// completed. The next Sync resumes it instead of starting a new pass.
+type SyncPass struct {
+	From      json.RawMessage `json:"from,omitempty"`         // documents with Field >= From are copied; empty copies every document
+	HighWater json.RawMessage `json:"high_water,omitempty"`   // mark saved when the pass completes
+	After     json.RawMessage `json:"search_after,omitempty"` // sort key of the last acknowledged document
+}
+
+// SyncStates of a state file keyed by source and destination.
+type SyncStates map[string]*SyncState
+
+func syncKey(src, dst string) string { return src + " -> " + dst }
+
+// LoadSyncStates reads a state file written by Sync. A missing file has no
+// states.
+func LoadSyncStates(path string) (SyncStates, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return SyncStates{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync state %s: %v", path, err)
+	}
+	states := SyncStates{}
+	if err := json.Unmarshal(b, &states); err != nil {
+		return nil, fmt.Errorf("error decoding sync state %s: %v", path, err)
+	}
+	return states, nil
+}
+
+// Save the states to path, replacing the file atomically.
+func (s SyncStates) Save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding sync state: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("error writing sync state %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Sync runs a pass copying the source documents that changed since the last
+// pass between the same indexes into the existing destination index. The
+// first pass is a full Copy, creating the destination unless des.SkipCreate.
+//
+// Documents are overwritten in the destination, so repeated passes converge
+// the indexes. Documents deleted from the source are not deleted from the
+// destination.
+//
+// The high-water mark is the largest cfg.Field in the source when the pass
+// starts and is only saved if the pass succeeds, so a failed pass is redone by
+// the next one. Documents that were dead-lettered are already recorded, so
+// they don't hold the mark back; the pass saves the mark and returns
+// ErrDeadLettered.
+//
+// If src.Sorted, the pass is checkpointed to cfg.State+".pass" as documents
+// are acknowledged. When ctx is done in the middle of the pass its progress is
+// saved in the state, and the next Sync resumes the pass after the last
+// acknowledged document.
+func Sync(ctx context.Context, src *SourceConfig, des *DesConfig, cfg *SyncConfig, logger log.Logger, logevery time.Duration) error {
+	srcUrl := src.URL()
+	priDesUrl := des.PrimaryURL()
+
+	states, err := LoadSyncStates(cfg.State)
+	if err != nil {
+		return err
+	}
+	key := syncKey(srcUrl, priDesUrl)
+	state, ok := states[key]
+	if !ok {
+		state = &SyncState{Source: srcUrl, Destination: priDesUrl, Field: cfg.Field}
+		states[key] = state
+	}
+	if state.Field != cfg.Field {
+		return fmt.Errorf("previous syncs used the field %s, not %s", state.Field, cfg.Field)
+	}
+
+	pass := state.Pass
+	if pass == nil {
+		// Find the mark before copying so documents changed during the pass are
+		// copied by the next one.
+		highwater, err := esindex.GetMax(srcUrl, cfg.Field)
+		if err != nil {
+			return fmt.Errorf("error getting high-water mark of %s: %v", cfg.Field, err)
+		}
+		pass = &SyncPass{From: state.HighWater, HighWater: highwater}
+		if len(pass.From) > 0 && cfg.Overlap != "" {
+			var s string
+			if err := json.Unmarshal(pass.From, &s); err != nil {
+				return fmt.Errorf("overlap requires a date field: %v", err)
+			}
+			pass.From, _ = json.Marshal(s + "||-" + cfg.Overlap)
+		}
+	} else if !src.Sorted {
+		return fmt.Errorf("resuming the interrupted sync pass requires a sorted source")
+	} else {
+		logger.Infof("Resuming the interrupted sync pass after %s", string(pass.After))
+	}
+
+	psrc, pdes := *src, *des
+	if len(pass.From) > 0 {
+		logger.Infof("Syncing documents with %s >= %s from %s to %s", cfg.Field, string(pass.From), srcUrl, priDesUrl)
+		rangeFilter := map[string]interface{}{
+			"range": map[string]interface{}{
+				cfg.Field: map[string]interface{}{"gte": pass.From},
+			},
+		}
+		if src.Filter == nil {
+			psrc.Filter = rangeFilter
+		} else {
+			psrc.Filter = map[string]interface{}{
+				"bool": map[string]interface{}{
+					"filter": []interface{}{src.Filter, rangeFilter},
+				},
+			}
+		}
+	} else {
+		logger.Infof("No previous sync from %s to %s; copying every document", srcUrl, priDesUrl)
+	}
+	switch _, err := esindex.Get(priDesUrl); {
+	case err == nil:
+		// the destination was set up by an earlier pass, even one that failed
+		pdes.SkipCreate = true
+		pdes.DelayRefresh = false
+		pdes.DelayReplicaton = false
+	case err != esindex.ErrMissing:
+		return fmt.Errorf("error checking for destination index: %v", err)
+	}
+	if src.Sorted {
+		psrc.After = pass.After
+		pdes.Checkpoint = cfg.State + ".pass"
+		pdes.Resume = false
+		os.Remove(pdes.Checkpoint)
+		defer os.Remove(pdes.Checkpoint)
+	}
+
+	cerr := Copy(ctx, &psrc, &pdes, logger, logevery)
+	if ctx.Err() != nil {
+		// save how far the pass got; acknowledged documents are in the destination
+		if pdes.Checkpoint != "" {
+			if cp, err := LoadCheckpoint(pdes.Checkpoint); err == nil && len(cp.After) > 0 {
+				pass.After = cp.After
+				state.Pass = pass
+				state.Updated = time.Now()
+				if err := states.Save(cfg.State); err != nil {
+					return err
+				}
+			}
+		}
+		if state.Pass == nil {
+			return fmt.Errorf("sync canceled: %v", ctx.Err())
+		}
+		return fmt.Errorf("sync canceled; the next pass resumes after %s: %v", string(state.Pass.After), ctx.Err())
+	}
+	if cerr != nil && cerr != ErrDeadLettered {
+		return cerr
+	}
+
+	if len(pass.HighWater) > 0 {
+		state.HighWater = pass.HighWater
+	}
+	state.Pass = nil
+	state.Passes++
+	state.Updated = time.Now()
+	if err := states.Save(cfg.State); err != nil {
+		return err
+	}
+	logger.Infof("sync pass %d completed; high-water mark of %s is %s", state.Passes, cfg.Field, string(state.HighWater))
+	return cerr
+}
@@ -3,37 +3,107 @@ package jobs
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/lytics/escp/esdiff"
 	"github.com/lytics/escp/esindex"
-	"github.com/lytics/escp/esscroll"
+	"github.com/lytics/escp/estypes"
 	log "github.com/lytics/escp/logging"
 )
 
 var ErrMissMatch = fmt.Errorf("missmatched results")
 
+// ValidateOptions for Validate.
+type ValidateOptions struct {
+	Denom int  // check 1/Denom of the source documents; < 2 checks every one
+	Extra bool // also read every destination id and report the documents that aren't in the source
+	Force bool // check the documents even if the indexes' document counts differ
+
+	Seed          int64  // documents are sampled by a hash of Seed and their _id, so a seed checks the same documents every run; 0 picks a random seed
+	Strata        string // stratify the sample by "_type" or a source field such as user.country, reporting each stratum's results
+	MinPerStratum int    // if Strata, documents of every stratum to check regardless of Denom, picked by the lowest hashes of the seed and _id
+
+	Digest     bool // compare every document by digests of buckets of both indexes sorted by _id instead of sampling
+	BucketSize int  // if Digest, source documents per bucket; < 1 will default to 1000
+
+	Rules *esdiff.Rules // differences to allow between the sources; nil compares them exactly
+
+	BatchSize   int // sampled documents to check per _mget request; < 1 will default to 100
+	Concurrency int // _mget requests to run in parallel; < 1 will default to 4
+}
+
 type ValidationResults struct {
-	Total       int
-	Checked     int
-	Missing     int
-	MissMatched int
-	Matched     int
-	Details     []string
+	Source      string         `json:"source"`
+	Destination string         `json:"destination"`
+	SourceCount uint64         `json:"source_count"`      // documents in the source index
+	DesCount    uint64         `json:"destination_count"` // documents in the destination index
+	Total       int            `json:"total"`
+	Checked     int            `json:"checked"`
+	Missing     int            `json:"missing"`
+	MissMatched int            `json:"mismatched"`
+	Matched     int            `json:"matched"`
+	Extra       int            `json:"extra"`             // destination documents not in the source, if ValidateOptions.Extra or Digest
+	Details     []*esdiff.Diff `json:"details,omitempty"` // the differences found, including which fields of mismatched documents changed
+	Denom       int            `json:"sample_rate"`       // 1/Denom of the source documents were checked
+	Seed        int64          `json:"seed"`              // seed of the sampling
+	Started     time.Time      `json:"started"`
+	Duration    time.Duration  `json:"duration_ns"`
+
+	Strata map[string]*StratumResults `json:"strata,omitempty"` // results by stratum, if ValidateOptions.Strata
+}
+
+// StratumResults are the results of the documents of one stratum.
+type StratumResults struct {
+	Total       int     `json:"total"` // documents read
+	Checked     int     `json:"checked"`
+	Missing     int     `json:"missing"`
+	MissMatched int     `json:"mismatched"`
+	Matched     int     `json:"matched"`
+	MatchRate   float64 `json:"match_rate"` // Matched/Checked
+}
+
+func (s *StratumResults) String() string {
+	return fmt.Sprintf("Checked %d/%d documents; missing=%d mismatched=%d matched=%d match_rate=%.4f",
+		s.Checked, s.Total, s.Missing, s.MissMatched, s.Matched, s.MatchRate)
 }
 
 func (v *ValidationResults) String() string {
-	return fmt.Sprintf("Checked %d/%d (%.1f%%) documents; missing=%d mismatched=%d matched=%d",
+	return fmt.Sprintf("Checked %d/%d (%.1f%%) documents; missing=%d mismatched=%d matched=%d extra=%d counts=%d/%d",
 		v.Checked, v.Total, (float64(v.Checked)/float64(v.Total))*100.0,
-		v.Missing, v.MissMatched, v.Matched)
+		v.Missing, v.MissMatched, v.Matched, v.Extra, v.SourceCount, v.DesCount)
+}
+
+// mismatched returns true if any difference was found, including differing
+// document counts.
+func (v *ValidationResults) mismatched() bool {
+	return v.SourceCount != v.DesCount || v.Missing+v.MissMatched+v.Extra > 0
 }
 
-func Validate(ctx context.Context, src *SourceConfig, des *DesConfig, denom int, logger log.Logger, logevery time.Duration) (*ValidationResults, error) {
-	dice := rand.New(rand.NewSource(time.Now().UnixNano()))
-	vr := &ValidationResults{}
+// Validate samples the source documents and checks them against the
+// destination, or compares every document if opts.Digest. Differing document
+// counts are a finding; unless opts.Force, opts.Extra or opts.Digest it aborts
+// early with ErrMissMatch when they differ.
+func Validate(ctx context.Context, src *SourceConfig, des *DesConfig, opts *ValidateOptions, logger log.Logger, logevery time.Duration) (*ValidationResults, error) {
+	denom := opts.Denom
+	if denom < 2 || opts.Digest {
+		denom = 1
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
 	desIdxUrl := fmt.Sprintf("%s/%s", des.Hosts[0], des.IndexName)
 	srcUrl := fmt.Sprintf("%s/%s", src.Host, src.IndexName)
+	vr := &ValidationResults{Source: srcUrl, Destination: desIdxUrl, Denom: denom, Seed: seed, Started: time.Now()}
+	defer func() { vr.Duration = time.Since(vr.Started) }()
+
+	if err := src.DetectVersion(logger); err != nil {
+		return vr, err
+	}
+	if err := des.DetectVersion(logger); err != nil {
+		return vr, err
+	}
 
 	// Make sure the totals are the same before we do a bunch of work
 	srccnt, err := esindex.GetDocCount(srcUrl)
@@ -44,47 +114,229 @@ func Validate(ctx context.Context, src *SourceConfig, des *DesConfig, denom int,
 	if err != nil {
 		return vr, fmt.Errorf("error getting des doc count: %v", err)
 	}
+	vr.SourceCount, vr.DesCount = srccnt, descnt
 	if srccnt != descnt {
 		logger.Warnf("Source and target have different document totals: %d vs. %d", srccnt, descnt)
-		vr.Details = []string{fmt.Sprintf("DocCountMissMatch: %d vs. %d", srccnt, descnt)}
-		return vr, ErrMissMatch
+		vr.Details = []*esdiff.Diff{{Kind: esdiff.DiffCount, Changes: []*esdiff.Change{
+			{Path: "_count", Kind: esdiff.ChangeChanged, Old: srccnt, New: descnt},
+		}}}
+		if !opts.Force && !opts.Extra && !opts.Digest {
+			return vr, ErrMissMatch
+		}
+	}
+
+	if opts.Digest {
+		return validateDigest(ctx, src, des, opts, vr, logger, logevery)
+	}
+
+	batchsz, par := opts.BatchSize, opts.Concurrency
+	if batchsz < 1 {
+		batchsz = 100
+	}
+	if par < 1 {
+		par = 4
 	}
 
 	// Start the scroll first to make sure the source parameter is valid
-	ess := esscroll.New(ctx, srcUrl, src.ScrollTimeout, src.ScrollPage, src.ScrollDocs, src.Filter, logevery, logger)
-	resp, err := ess.Start()
+	sctx, can := context.WithCancel(ctx)
+	defer can()
+	resp, err := src.Source(sctx, logger, logevery).Start()
 	if err != nil {
 		return vr, fmt.Errorf("error starting scroll: %v", err)
 	}
 
 	vr.Total = int(resp.Total)
 
-	logger.Infof("Scrolling over %d documents from %v \n", resp.Total, srcUrl)
+	logger.Infof("Scrolling over %d documents from %v with seed %d\n", resp.Total, srcUrl, seed)
 
+	// check batches of sampled documents in parallel
+	var mu sync.Mutex
+	var checkErr error
+	if opts.Strata != "" {
+		vr.Strata = map[string]*StratumResults{}
+	}
+	batches := make(chan *sampleBatch, par)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < par; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				diffs, err := esdiff.CheckBatch(batch.docs, desIdxUrl, des.Typeless, opts.Rules, logger)
+				mu.Lock()
+				if err != nil {
+					if checkErr == nil {
+						checkErr = err
+					}
+					can()
+				}
+				for i, diff := range diffs {
+					sr := &StratumResults{}
+					if vr.Strata != nil {
+						if sr = vr.Strata[batch.strata[i]]; sr == nil {
+							sr = &StratumResults{}
+							vr.Strata[batch.strata[i]] = sr
+						}
+					}
+					vr.Checked++
+					sr.Checked++
+					switch {
+					case diff == nil:
+						vr.Matched++
+						sr.Matched++
+						continue
+					case diff.Kind == esdiff.DiffMissing:
+						vr.Missing++
+						sr.Missing++
+					default:
+						vr.MissMatched++
+						sr.MissMatched++
+					}
+					vr.Details = append(vr.Details, diff)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	sampler := newSampler(seed, denom, opts.Strata, opts.MinPerStratum)
+	batch := &sampleBatch{}
+	add := func(doc *estypes.Doc, stratum string) {
+		batch.docs = append(batch.docs, doc)
+		batch.strata = append(batch.strata, stratum)
+		if len(batch.docs) == batchsz {
+			select {
+			case batches <- batch:
+			case <-sctx.Done():
+			}
+			batch = &sampleBatch{}
+		}
+	}
 	for doc := range resp.Hits {
-		if denom == 1 || dice.Intn(denom) == 0 {
-			vr.Checked++
-			diff, err := esdiff.Check(doc, desIdxUrl, logger)
-			if err != nil {
-				return vr, fmt.Errorf("fatal escheck error: %v", err)
+		if stratum, ok := sampler.sample(doc); ok {
+			add(doc, stratum)
+		}
+	}
+	// top up the small strata once every document has been sampled
+	docs, strata := sampler.extra()
+	for i := 0; i < len(docs); i += batchsz {
+		end := i + batchsz
+		if end > len(docs) {
+			end = len(docs)
+		}
+		got, err := esindex.MultiGet(srcUrl, docs[i:end], false)
+		if err != nil {
+			mu.Lock()
+			if checkErr == nil {
+				checkErr = fmt.Errorf("error getting source documents: %v", err)
+			}
+			mu.Unlock()
+			break
+		}
+		for j, doc := range got {
+			// nil if deleted from the source since it was read
+			if doc != nil {
+				add(doc, strata[i+j])
+			}
+		}
+	}
+	if len(batch.docs) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+	if vr.Strata != nil {
+		for stratum, n := range sampler.seen {
+			sr := vr.Strata[stratum]
+			if sr == nil {
+				sr = &StratumResults{}
+				vr.Strata[stratum] = sr
 			}
-			switch diff {
-			case "":
-				vr.Matched++
-			case esdiff.DiffMissing:
-				vr.Missing++
-				vr.Details = append(vr.Details, fmt.Sprintf("MissingDoc:%v", doc.ID))
-			default:
-				vr.MissMatched++
-				vr.Details = append(vr.Details, fmt.Sprintf("DocMissMatch:%v", doc.ID))
+			sr.Total = n
+			if sr.Checked > 0 {
+				sr.MatchRate = float64(sr.Matched) / float64(sr.Checked)
 			}
+			logger.Infof("stratum %q: %v", stratum, sr)
 		}
 	}
+	if checkErr != nil {
+		return vr, fmt.Errorf("fatal escheck error: %v", checkErr)
+	}
 	if resp.Err() != nil {
 		return vr, fmt.Errorf("scoll error:%v", resp.Err())
 	}
 
-	if vr.Missing+vr.MissMatched > 0 {
+	if opts.Extra {
+		_, _, err := extraDocs(ctx, src, des, logger, logevery, func(doc *estypes.Doc) error {
+			vr.Extra++
+			vr.Details = append(vr.Details, &esdiff.Diff{ID: doc.ID, Kind: esdiff.DiffExtra})
+			return nil
+		})
+		if err != nil {
+			return vr, fmt.Errorf("error finding extra documents: %v", err)
+		}
+	}
+
+	if vr.mismatched() {
+		return vr, ErrMissMatch
+	}
+	return vr, nil
+}
+
+// sampleBatch is a batch of sampled documents and their strata.
+type sampleBatch struct {
+	docs   []*estypes.Doc
+	strata []string
+}
+
+// validateDigest compares every document of the source and destination
+// indexes read sorted by _id, only comparing the documents of buckets whose
+// digests differ.
+func validateDigest(ctx context.Context, src *SourceConfig, des *DesConfig, opts *ValidateOptions, vr *ValidationResults, logger log.Logger, logevery time.Duration) (*ValidationResults, error) {
+	ssrc, dsrc := sortedSources(src, des, false)
+
+	ctx, can := context.WithCancel(ctx)
+	defer can()
+	sresp, err := ssrc.Source(ctx, logger, logevery).Start()
+	if err != nil {
+		return vr, fmt.Errorf("error reading source: %v", err)
+	}
+	dresp, err := dsrc.Source(ctx, logger, logevery).Start()
+	if err != nil {
+		return vr, fmt.Errorf("error reading destination: %v", err)
+	}
+	logger.Infof("Comparing digests of %d source documents with %d destination documents", sresp.Total, dresp.Total)
+
+	stats, err := esdiff.CompareSorted(sresp.Hits, dresp.Hits, opts.BucketSize, des.Typeless, opts.Rules, func(diff *esdiff.Diff) {
+		switch diff.Kind {
+		case esdiff.DiffMissing:
+			vr.Missing++
+		case esdiff.DiffExtra:
+			vr.Extra++
+		default:
+			vr.MissMatched++
+		}
+		vr.Details = append(vr.Details, diff)
+	})
+	if err != nil {
+		return vr, fmt.Errorf("fatal escheck error: %v", err)
+	}
+	// an unfinished read must not be taken as missing or extra documents
+	if err := sresp.Err(); err != nil {
+		return vr, fmt.Errorf("error reading source: %v", err)
+	}
+	if err := dresp.Err(); err != nil {
+		return vr, fmt.Errorf("error reading destination: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return vr, err
+	}
+	logger.Infof("digest comparison completed: %v", stats)
+
+	vr.Total = stats.Source
+	vr.Checked = stats.Source
+	vr.Matched = stats.Source - vr.Missing - vr.MissMatched
+	if vr.mismatched() {
 		return vr, ErrMissMatch
 	}
 	return vr, nil
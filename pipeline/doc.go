@@ -0,0 +1,3 @@
+// This package defines the sources and sinks documents flow through when they
+// are copied, so the copy jobs aren't tied to Elasticsearch on either end.
+package pipeline
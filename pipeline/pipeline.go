@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lytics/escp/estypes"
+)
+
+// Source of documents, such as a scroll over an Elasticsearch index.
+type Source interface {
+	// Start reading documents.
+	//
+	// When Response.Hits is closed, Response.Err() should be checked to see if
+	// reading completed successfully or not.
+	Start() (*Response, error)
+}
+
+// Sink for documents, such as a bulk indexer writing to an Elasticsearch
+// index.
+type Sink interface {
+	// Write documents from docs until it is closed. Any errors are sent on the
+	// returned channel, which is closed once writing has finished.
+	//
+	// Sends to docs should select on the returned channel to prevent
+	// deadlocking in case of error.
+	Write(ctx context.Context, docs <-chan *estypes.Doc) <-chan error
+}
+
+// Response of a Source.
+type Response struct {
+	Total uint64
+	Hits  <-chan *estypes.Doc
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewResponse for a source with total documents that will be sent on hits.
+func NewResponse(total uint64, hits <-chan *estypes.Doc) *Response {
+	return &Response{Total: total, Hits: hits}
+}
+
+// SetErr records the error that stopped the source. It should be called before
+// Hits is closed.
+func (r *Response) SetErr(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+func (r *Response) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Pipe writes every document from source to sink and waits for the sink to
+// finish. It returns the first error of either.
+func Pipe(ctx context.Context, source Source, sink Sink) (*Response, error) {
+	resp, err := source.Start()
+	if err != nil {
+		return nil, err
+	}
+	if err := <-sink.Write(ctx, resp.Hits); err != nil {
+		return resp, err
+	}
+	return resp, resp.Err()
+}